@@ -10,95 +10,278 @@ package builder
 // upload it in one reading pass.
 import (
 	"archive/tar"
-	"compress/gzip"
 	"crypto/sha256"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
 
 	"github.com/google/nixery/layers"
+	"github.com/google/nixery/manifest"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
 )
 
+// Size of the blocks that gzip streams are split into for parallel
+// compression. Changing this changes the resulting layer digests.
+const gzipBlockSize = 1 << 20
+
+// compressWriter wraps the supplied writer in a compressor for the
+// given compression algorithm.
+//
+// gzip streams are compressed in independent blocks on multiple
+// cores. The output is a standard gzip stream, and identical for
+// identical input as the block size is fixed.
+//
+// eStargz layers can not be written as a stream and are handled
+// separately in packEstargz.
+func compressWriter(c manifest.Compression, w io.Writer) (io.WriteCloser, error) {
+	if c == manifest.Zstd {
+		return zstd.NewWriter(w)
+	}
+
+	gz := pgzip.NewWriter(w)
+	if err := gz.SetConcurrency(gzipBlockSize, runtime.GOMAXPROCS(0)); err != nil {
+		return nil, err
+	}
+
+	return gz, nil
+}
+
+// layerInfo contains metadata about a layer that is only known once
+// the layer has been written.
+type layerInfo struct {
+	// SHA256 hash of the uncompressed tarball, in digest form
+	TarHash string
+
+	// Annotations to attach to the layer in OCI manifests
+	Annotations map[string]string
+}
+
 // Create a new compressed tarball from each of the paths in the list
 // and write it to the supplied writer.
 //
 // The uncompressed tarball is hashed because image manifests must
 // contain both the hashes of compressed and uncompressed layers.
-func packStorePaths(l *layers.Layer, w io.Writer) (string, error) {
-	shasum := sha256.New()
-	gz := gzip.NewWriter(w)
-	multi := io.MultiWriter(shasum, gz)
-	t := tar.NewWriter(multi)
+func packStorePaths(l *layers.Layer, w io.Writer, c manifest.Compression) (layerInfo, error) {
+	if c == manifest.Estargz {
+		return packEstargz(l, w)
+	}
 
-	for _, path := range l.Contents {
-		err := filepath.Walk(path, tarStorePath(t))
-		if err != nil {
-			return "", err
-		}
+	shasum := sha256.New()
+	gz, err := compressWriter(c, w)
+	if err != nil {
+		return layerInfo{}, err
 	}
 
-	if err := t.Close(); err != nil {
-		return "", err
+	if err := writeStorePaths(l, io.MultiWriter(shasum, gz)); err != nil {
+		return layerInfo{}, err
 	}
 
 	if err := gz.Close(); err != nil {
-		return "", err
+		return layerInfo{}, err
 	}
 
-	return fmt.Sprintf("sha256:%x", shasum.Sum([]byte{})), nil
+	return layerInfo{
+		TarHash: fmt.Sprintf("sha256:%x", shasum.Sum([]byte{})),
+	}, nil
 }
 
-func tarStorePath(w *tar.Writer) filepath.WalkFunc {
-	return func(path string, info os.FileInfo, err error) error {
-		if err != nil {
+// writeStorePaths writes an uncompressed tarball of all paths in the
+// layer to the supplied writer.
+func writeStorePaths(l *layers.Layer, w io.Writer) error {
+	t := tar.NewWriter(w)
+	sw := newStoreWriter(t)
+
+	for _, path := range l.Contents {
+		if err := sw.writeParents(path); err != nil {
 			return err
 		}
 
-		// If the entry is not a symlink or regular file, skip it.
-		if info.Mode()&os.ModeSymlink == 0 && !info.Mode().IsRegular() {
-			return nil
+		err := filepath.Walk(path, sw.tarStorePath)
+		if err != nil {
+			return err
 		}
+	}
+
+	return t.Close()
+}
+
+// inode identifies a file on the host, which is used to detect
+// hardlinks (for example those created by Nix store optimisation).
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// storeWriter keeps track of the entries already written to a layer
+// tarball while walking through its store paths.
+type storeWriter struct {
+	w *tar.Writer
+
+	// Directories that already have an entry in the tarball.
+	dirs map[string]bool
+
+	// First path at which a file with multiple links was written.
+	links map[inode]string
+}
+
+func newStoreWriter(w *tar.Writer) *storeWriter {
+	return &storeWriter{
+		w:     w,
+		dirs:  make(map[string]bool),
+		links: make(map[inode]string),
+	}
+}
 
-		// the symlink target is read if this entry is a symlink, as it
-		// is required when creating the file header
-		var link string
-		if info.Mode()&os.ModeSymlink != 0 {
-			link, err = os.Readlink(path)
-			if err != nil {
-				return err
-			}
+// writeParents emits directory entries for all parents of a store
+// path (such as `/nix` and `/nix/store`) which are not yet part of
+// the tarball, outermost directory first.
+func (sw *storeWriter) writeParents(path string) error {
+	var parents []string
+	for dir := filepath.Dir(path); dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		parents = append([]string{dir}, parents...)
+	}
+
+	for _, dir := range parents {
+		if sw.dirs[dir] {
+			continue
 		}
 
-		header, err := tar.FileInfoHeader(info, link)
-		if err != nil {
-			return err
+		header := &tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     dir + "/",
 		}
+		normaliseHeader(header)
 
-		// The name retrieved from os.FileInfo only contains the file's
-		// basename, but the full path is required within the layer
-		// tarball.
-		header.Name = path
-		if err = w.WriteHeader(header); err != nil {
+		if err := sw.w.WriteHeader(header); err != nil {
 			return err
 		}
 
-		// At this point, return if no file content needs to be written
-		if !info.Mode().IsRegular() {
-			return nil
+		sw.dirs[dir] = true
+	}
+
+	return nil
+}
+
+// Modification time used for all entries in layer tarballs. This
+// matches the timestamp used by Nix for store paths.
+var storeEpoch = time.Unix(1, 0)
+
+// normaliseHeader strips all host-specific metadata from a tar header,
+// leaving only the information that Nix itself preserves for store
+// paths.
+//
+// This ensures that identical store paths result in bit-identical
+// layers, independent of the host the layer was built on.
+func normaliseHeader(h *tar.Header) {
+	h.ModTime = storeEpoch
+	h.AccessTime = time.Time{}
+	h.ChangeTime = time.Time{}
+	h.Uid = 0
+	h.Gid = 0
+	h.Uname = ""
+	h.Gname = ""
+	h.PAXRecords = nil
+	h.Xattrs = nil
+	h.Devmajor = 0
+	h.Devminor = 0
+
+	// Nix canonicalises permissions in the store to either 0444
+	// or 0555 (for executables), symlinks are always 0777.
+	switch h.Typeflag {
+	case tar.TypeSymlink:
+		h.Mode = 0777
+	case tar.TypeDir:
+		// Directories in the store are always traversable.
+		h.Mode = 0555
+	default:
+		if h.Mode&0111 != 0 {
+			h.Mode = 0555
+		} else {
+			h.Mode = 0444
 		}
+	}
+
+	// The GNU format supports long names without falling back to
+	// PAX records, which would otherwise embed additional
+	// (potentially host-specific) metadata.
+	h.Format = tar.FormatGNU
+}
+
+func (sw *storeWriter) tarStorePath(path string, info os.FileInfo, err error) error {
+	if err != nil {
+		return err
+	}
+
+	mode := info.Mode()
+	if !mode.IsDir() && !mode.IsRegular() && mode&os.ModeSymlink == 0 {
+		return fmt.Errorf("unsupported file type %s in store path: %s", mode.Type(), path)
+	}
 
-		f, err := os.Open(path)
+	if mode.IsDir() && sw.dirs[path] {
+		return nil
+	}
+
+	// the symlink target is read if this entry is a symlink, as it
+	// is required when creating the file header
+	var link string
+	if mode&os.ModeSymlink != 0 {
+		link, err = os.Readlink(path)
 		if err != nil {
 			return err
 		}
+	}
 
-		if _, err := io.Copy(w, f); err != nil {
-			return err
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+
+	// The name retrieved from os.FileInfo only contains the file's
+	// basename, but the full path is required within the layer
+	// tarball.
+	header.Name = path
+	if mode.IsDir() {
+		header.Name += "/"
+		sw.dirs[path] = true
+	}
+
+	// Regular files with multiple links are only written once,
+	// subsequent occurrences become hardlinks to the first one.
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && mode.IsRegular() && st.Nlink > 1 {
+		id := inode{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+		if target, seen := sw.links[id]; seen {
+			header.Typeflag = tar.TypeLink
+			header.Linkname = target
+			header.Size = 0
+		} else {
+			sw.links[id] = path
 		}
+	}
 
-		f.Close()
+	normaliseHeader(header)
+	if err = sw.w.WriteHeader(header); err != nil {
+		return err
+	}
 
+	// At this point, return if no file content needs to be written
+	if header.Typeflag != tar.TypeReg {
 		return nil
 	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(sw.w, f); err != nil {
+		return err
+	}
+
+	return nil
 }
@@ -0,0 +1,336 @@
+// Copyright The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/google/nixery/layers"
+	"github.com/google/nixery/manifest"
+	"github.com/klauspost/compress/zstd"
+)
+
+// writeTestPath creates a small fake store path at the given location.
+func writeTestPath(t *testing.T, root string, mtime time.Time, mode os.FileMode) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Join(root, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]os.FileMode{
+		"bin/hello":  mode | 0111,
+		"README.txt": mode,
+	}
+
+	for name, m := range files {
+		p := filepath.Join(root, name)
+		if err := os.WriteFile(p, []byte("content of "+name), m); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(p, m); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.Symlink("bin/hello", filepath.Join(root, "hello")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func packTestLayer(t *testing.T, path string) (string, []byte) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	l := layers.Layer{Contents: []string{path}}
+	info, err := packStorePaths(&l, &buf, manifest.Gzip)
+	if err != nil {
+		t.Fatalf("failed to pack store paths: %s", err)
+	}
+
+	return info.TarHash, buf.Bytes()
+}
+
+func TestPackStorePathsReproducible(t *testing.T) {
+	// Both directories use the same relative name, so that the
+	// store path names in the tarball are identical after
+	// changing into them.
+	first := t.TempDir()
+	second := t.TempDir()
+
+	writeTestPath(t, filepath.Join(first, "store"), time.Unix(1000, 0), 0600)
+	writeTestPath(t, filepath.Join(second, "store"), time.Unix(2000000, 0), 0644)
+
+	t.Chdir(first)
+	hashA, layerA := packTestLayer(t, "store")
+
+	t.Chdir(second)
+	hashB, layerB := packTestLayer(t, "store")
+
+	if hashA != hashB {
+		t.Errorf("tarball hashes differ between hosts: %s != %s", hashA, hashB)
+	}
+
+	if !bytes.Equal(layerA, layerB) {
+		t.Errorf("compressed layers differ between hosts")
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(layerA))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if h.Uid != 0 || h.Gid != 0 || h.Uname != "" || h.Gname != "" {
+			t.Errorf("%s: unexpected ownership %d:%d (%s:%s)", h.Name, h.Uid, h.Gid, h.Uname, h.Gname)
+		}
+
+		if !h.ModTime.Equal(storeEpoch) {
+			t.Errorf("%s: unexpected mtime %s", h.Name, h.ModTime)
+		}
+
+		if len(h.PAXRecords) != 0 {
+			t.Errorf("%s: unexpected PAX records %v", h.Name, h.PAXRecords)
+		}
+	}
+}
+
+func readTestLayer(t *testing.T, layer []byte) map[string]*tar.Header {
+	t.Helper()
+
+	gz, err := gzip.NewReader(bytes.NewReader(layer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers := make(map[string]*tar.Header)
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return headers
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		headers[h.Name] = h
+	}
+}
+
+func TestPackStorePathsEntries(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	path := "nix/store/abc-test"
+	writeTestPath(t, path, time.Unix(1000, 0), 0644)
+
+	if err := os.Mkdir(filepath.Join(path, "empty"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Link(filepath.Join(path, "bin/hello"), filepath.Join(path, "hello-again")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, layer := packTestLayer(t, path)
+	headers := readTestLayer(t, layer)
+
+	for _, dir := range []string{"nix/", "nix/store/", path + "/", path + "/bin/", path + "/empty/"} {
+		h, ok := headers[dir]
+		if !ok {
+			t.Errorf("missing directory entry %s", dir)
+			continue
+		}
+
+		if h.Typeflag != tar.TypeDir || h.Mode != 0555 {
+			t.Errorf("%s: unexpected type %c or mode %o", dir, h.Typeflag, h.Mode)
+		}
+	}
+
+	link, ok := headers[path+"/hello-again"]
+	if !ok {
+		t.Fatalf("missing hardlinked file")
+	}
+
+	if link.Typeflag != tar.TypeLink || link.Linkname != path+"/bin/hello" {
+		t.Errorf("expected hardlink to bin/hello, got type %c to %q", link.Typeflag, link.Linkname)
+	}
+}
+
+func TestPackStorePathsUnsupported(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	if err := os.Mkdir("store", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := syscall.Mkfifo("store/fifo", 0644); err != nil {
+		t.Skipf("could not create fifo: %s", err)
+	}
+
+	l := layers.Layer{Contents: []string{"store"}}
+	if _, err := packStorePaths(&l, io.Discard, manifest.Gzip); err == nil {
+		t.Fatal("expected packing a fifo to fail")
+	}
+}
+
+func TestPackStorePathsZstd(t *testing.T) {
+	t.Chdir(t.TempDir())
+	writeTestPath(t, "store", time.Unix(1000, 0), 0644)
+
+	l := layers.Layer{Contents: []string{"store"}}
+
+	var gzbuf, zbuf bytes.Buffer
+	gzinfo, err := packStorePaths(&l, &gzbuf, manifest.Gzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zinfo, err := packStorePaths(&l, &zbuf, manifest.Zstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gzinfo.TarHash != zinfo.TarHash {
+		t.Errorf("uncompressed tarballs differ between compressions: %s != %s", gzinfo.TarHash, zinfo.TarHash)
+	}
+
+	zr, err := zstd.NewReader(&zbuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	if _, err := tar.NewReader(zr).Next(); err != nil {
+		t.Fatalf("failed to read zstd-compressed layer: %s", err)
+	}
+}
+
+func TestPackStorePathsEstargz(t *testing.T) {
+	t.Chdir(t.TempDir())
+	writeTestPath(t, "store", time.Unix(1000, 0), 0644)
+
+	l := layers.Layer{Contents: []string{"store"}}
+
+	var buf bytes.Buffer
+	info, err := packStorePaths(&l, &buf, manifest.Estargz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob := bytes.NewReader(buf.Bytes())
+	r, err := estargz.Open(io.NewSectionReader(blob, 0, blob.Size()))
+	if err != nil {
+		t.Fatalf("failed to open eStargz layer: %s", err)
+	}
+
+	if _, ok := r.Lookup("store/bin/hello"); !ok {
+		t.Error("eStargz table of contents is missing store/bin/hello")
+	}
+
+	if info.Annotations[estargz.TOCJSONDigestAnnotation] == "" {
+		t.Error("missing TOC digest annotation")
+	}
+
+	if !strings.HasPrefix(info.TarHash, "sha256:") {
+		t.Errorf("unexpected diff ID %q", info.TarHash)
+	}
+}
+
+// benchmarkData returns a compressible buffer resembling the contents
+// of a large store path.
+func benchmarkData(size int) []byte {
+	var buf bytes.Buffer
+	rng := rand.New(rand.NewPCG(1, 2))
+	for buf.Len() < size {
+		fmt.Fprintf(&buf, "/nix/store/%x-package-%d/lib/lib%d.so\n", rng.Uint64(), rng.IntN(1000), rng.IntN(100))
+		buf.Write(bytes.Repeat([]byte{byte(rng.IntN(256))}, rng.IntN(64)))
+	}
+
+	return buf.Bytes()[:size]
+}
+
+func benchmarkCompression(b *testing.B, newWriter func(io.Writer) io.WriteCloser) {
+	data := benchmarkData(64 << 20)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		w := newWriter(io.Discard)
+		if _, err := w.Write(data); err != nil {
+			b.Fatal(err)
+		}
+
+		if err := w.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGzipSingleCore(b *testing.B) {
+	benchmarkCompression(b, func(w io.Writer) io.WriteCloser {
+		return gzip.NewWriter(w)
+	})
+}
+
+func BenchmarkGzipParallel(b *testing.B) {
+	benchmarkCompression(b, func(w io.Writer) io.WriteCloser {
+		gz, _ := compressWriter(manifest.Gzip, w)
+		return gz
+	})
+}
+
+func TestParallelGzipDeterministic(t *testing.T) {
+	data := benchmarkData(8 << 20)
+
+	compress := func() []byte {
+		var buf bytes.Buffer
+		gz, err := compressWriter(manifest.Gzip, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		gz.Write(data)
+		gz.Close()
+		return buf.Bytes()
+	}
+
+	first := compress()
+	if !bytes.Equal(first, compress()) {
+		t.Fatal("parallel gzip output is not deterministic")
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(out, data) {
+		t.Fatalf("parallel gzip output can not be read as a standard gzip stream: %v", err)
+	}
+}
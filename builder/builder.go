@@ -9,8 +9,8 @@ package builder
 
 import (
 	"bytes"
-	"compress/gzip"
 	"context"
+	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
@@ -25,6 +25,7 @@ import (
 	"github.com/google/nixery/manifest"
 	"github.com/google/nixery/storage"
 	"github.com/im7mortal/kmutex"
+	"golang.org/x/sync/errgroup"
 	"log/slog"
 )
 
@@ -67,6 +68,10 @@ type Image struct {
 	Name string
 	Tag  string
 
+	// Name of the package source to build the image from. The
+	// default source is named "".
+	Source string
+
 	// Names of packages to include in the image. These must correspond
 	// directly to top-level names of Nix packages in the nixpkgs tree.
 	Packages []string
@@ -74,6 +79,11 @@ type Image struct {
 	// Architecture for which to build the image. Nixery defaults
 	// this to amd64 if not specified via meta-packages.
 	Arch *Architecture
+
+	// Compression to use for the image layers. This depends on
+	// the manifest types accepted by the client and defaults to
+	// gzip.
+	Compression manifest.Compression
 }
 
 // BuildResult represents the data returned from the server to the
@@ -111,6 +121,16 @@ func ImageFromName(name string, tag string) Image {
 	}
 }
 
+// FullName returns the name of the image including its package source,
+// which identifies images across sources.
+func (i *Image) FullName() string {
+	if i.Source == "" {
+		return i.Name
+	}
+
+	return i.Source + "/" + i.Name
+}
+
 // ImageResult represents the output of calling the Nix derivation
 // responsible for preparing an image.
 type ImageResult struct {
@@ -144,7 +164,7 @@ func metaPackages(packages []string) (*Architecture, []string) {
 	var metapkgs []string
 	lastMeta := 0
 	for idx, p := range packages {
-		if p == "shell" || p == "arm64" {
+		if config.IsMetaPackage(p) {
 			metapkgs = append(metapkgs, p)
 			lastMeta = idx + 1
 		} else {
@@ -168,8 +188,9 @@ func metaPackages(packages []string) (*Architecture, []string) {
 	return arch, packages
 }
 
-func callNix(program, image string, args []string, ec *ErrorCache) ([]byte, error) {
+func callNix(program, image string, args, env []string, ec *ErrorCache) ([]byte, error) {
 	cmd := exec.Command(program, args...)
+	cmd.Env = env
 
 	outpipe, err := cmd.StdoutPipe()
 	if err != nil {
@@ -212,19 +233,40 @@ func callNix(program, image string, args []string, ec *ErrorCache) ([]byte, erro
 	return buildOutput, nil
 }
 
+// nixpkgsArgs returns the arguments passing the nixpkgs configuration
+// of a package source to Nix. Unset arguments are left out, so that
+// the defaults of prepare-image apply.
+func nixpkgsArgs(a *config.NixpkgsArgs) []string {
+	if a == nil {
+		return nil
+	}
+
+	var args []string
+	if a.Config != "" {
+		args = append(args, "--argstr", "nixpkgsConfig", a.Config)
+	}
+
+	if len(a.Overlays) > 0 {
+		overlays, _ := json.Marshal(a.Overlays)
+		args = append(args, "--argstr", "overlays", string(overlays))
+	}
+
+	return args
+}
+
 // Call out to Nix and request metadata for the image to be built. All
 // required store paths for the image will be realised, but layers
 // will not yet be created from them.
 //
 // This function is only invoked if the manifest is not found in any
 // cache.
-func prepareImage(s *State, image *Image) (*ImageResult, error) {
+func prepareImage(s *State, image *Image, pkgs config.PkgSource) (*ImageResult, error) {
 	packages, err := json.Marshal(image.Packages)
 	if err != nil {
 		return nil, err
 	}
 
-	srcType, srcArgs := s.Cfg.Pkgs.Render(image.Tag)
+	srcType, srcArgs := pkgs.Render(image.Tag)
 
 	args := []string{
 		"--timeout", s.Cfg.Timeout,
@@ -234,7 +276,18 @@ func prepareImage(s *State, image *Image) (*ImageResult, error) {
 		"--argstr", "system", image.Arch.nixSystem,
 	}
 
-	output, err := callNix("nixery-prepare-image", image.Name, args, s.Errors)
+	if srcType == "flake" {
+		args = append(args, "--extra-experimental-features", "nix-command flakes")
+	}
+
+	args = append(args, nixpkgsArgs(s.Cfg.NixpkgsArgs[image.Source])...)
+
+	// Credentials of the package source are only passed to Nix
+	// through its environment, so that they do not show up in
+	// command lines.
+	env := s.Cfg.Credentials[image.Source].Env()
+
+	output, err := callNix("nixery-prepare-image", image.FullName(), args, env, s.Errors)
 	if err != nil {
 		// granular error logging is performed in callNix already
 		return nil, err
@@ -260,84 +313,128 @@ func prepareImage(s *State, image *Image) (*ImageResult, error) {
 func prepareLayers(ctx context.Context, s *State, image *Image, result *ImageResult) ([]manifest.Entry, error) {
 	grouped := layers.GroupLayers(&result.Graph, &s.Pop, LayerBudget)
 
-	var entries []manifest.Entry
+	// Each layer (and the symlink layer) writes its entry into a
+	// fixed slot, which keeps the order of entries deterministic
+	// regardless of the order in which uploads finish.
+	entries := make([]manifest.Entry, len(grouped)+1)
+
+	// Uncached layers are built and uploaded by a bounded pool of
+	// workers. The first error cancels all remaining builds.
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(s.Cfg.Workers, 1))
 
 	// Splits the layers into those which are already present in
 	// the cache, and those that are missing.
 	//
 	// Missing layers are built and uploaded to the storage
 	// bucket.
-	for _, l := range grouped {
-		lh := l.Hash()
-
-		// While packing store paths, the SHA sum of
-		// the uncompressed layer is computed and
-		// written to `tarhash`.
-		//
-		// TODO(tazjin): Refactor this to make the
-		// flow of data cleaner.
-		lw := func(w io.Writer) (string, error) {
-			tarhash, err := packStorePaths(&l, w)
-			if err != nil {
-				return "", err
-			}
+	for i, l := range grouped {
+		g.Go(func() error {
+			lh := variantKey(l.Hash(), image.Compression)
 
 			var pkgs []string
 			for _, p := range l.Contents {
 				pkgs = append(pkgs, layers.PackageFromPath(p))
 			}
 
-			slog.Info("created image layer", "layer", lh, "packages", pkgs, "tarhash", tarhash)
+			// While packing store paths, the SHA sum of
+			// the uncompressed layer is computed and
+			// returned as part of the layer info.
+			lw := func(w io.Writer) (layerInfo, error) {
+				info, err := packStorePaths(&l, w, image.Compression)
+				if err != nil {
+					return layerInfo{}, err
+				}
 
-			return tarhash, err
-		}
+				slog.Info("created image layer", "layer", lh, "packages", pkgs, "tarhash", info.TarHash)
 
-		entry, err := uploadHashLayer(ctx, s, lh, l.MergeRating, lw)
-		if err != nil {
-			return nil, err
-		}
+				return info, err
+			}
 
-		entries = append(entries, *entry)
+			entry, err := uploadHashLayer(ctx, s, lh, image.Compression.LayerType(), l.MergeRating, lw)
+			if err != nil {
+				return err
+			}
+
+			entry.CreatedBy = "nixery: " + strings.Join(pkgs, " ")
+			entries[i] = *entry
+			return nil
+		})
 	}
 
 	// Symlink layer (built in the first Nix build) needs to be
-	// included here manually:
-	slkey := result.SymlinkLayer.TarHash
-	entry, err := uploadHashLayer(ctx, s, slkey, 0, func(w io.Writer) (string, error) {
-		f, err := os.Open(result.SymlinkLayer.Path)
-		if err != nil {
-			slog.Error("failed to open symlink layer", "err", err, "image", image.Name, "tag", image.Tag, "layer", slkey)
+	// included here manually.
+	//
+	// It is small and only contains symlinks, so eStargz images
+	// use a plain gzip stream for it, which lazy pulling clients
+	// fetch eagerly.
+	slcompression := image.Compression
+	if slcompression == manifest.Estargz {
+		slcompression = manifest.Gzip
+	}
 
-			return "", err
-		}
-		defer f.Close()
+	slhash := result.SymlinkLayer.TarHash
+	slkey := variantKey(slhash, slcompression)
+	g.Go(func() error {
+		entry, err := uploadHashLayer(ctx, s, slkey, slcompression.LayerType(), 0, func(w io.Writer) (layerInfo, error) {
+			f, err := os.Open(result.SymlinkLayer.Path)
+			if err != nil {
+				slog.Error("failed to open symlink layer", "err", err, "image", image.Name, "tag", image.Tag, "layer", slkey)
 
-		gz := gzip.NewWriter(w)
-		_, err = io.Copy(gz, f)
-		if err != nil {
-			slog.Error("failed to upload symlink layer", "err", err, "image", image.Name, "tag", image.Tag, "layer", slkey)
+				return layerInfo{}, err
+			}
+			defer f.Close()
+
+			gz, err := compressWriter(slcompression, w)
+			if err != nil {
+				return layerInfo{}, err
+			}
+
+			_, err = io.Copy(gz, f)
+			if err != nil {
+				slog.Error("failed to upload symlink layer", "err", err, "image", image.Name, "tag", image.Tag, "layer", slkey)
+
+				return layerInfo{}, err
+			}
 
-			return "", err
+			return layerInfo{TarHash: "sha256:" + slhash}, gz.Close()
+		})
+
+		if err != nil {
+			return err
 		}
 
-		return "sha256:" + slkey, gz.Close()
+		entry.CreatedBy = "nixery: symlink layer for " + image.Name
+		entries[len(grouped)] = *entry
+		return nil
 	})
 
-	if err != nil {
+	if err := g.Wait(); err != nil {
 		return nil, err
 	}
 
-	entries = append(entries, *entry)
-
 	return entries, nil
 }
 
+// variantKey returns the cache key for the variant of a layer or
+// manifest with the specified compression.
+//
+// All variants are cached separately, gzip-compressed variants use
+// the plain key for compatibility with existing caches.
+func variantKey(key string, c manifest.Compression) string {
+	if c == manifest.Gzip {
+		return key
+	}
+
+	return key + "-" + c.String()
+}
+
 // layerWriter is the type for functions that can write a layer to the
 // multiwriter used for uploading & hashing.
 //
 // This type exists to avoid duplication between the handling of
 // symlink layers and store path layers.
-type layerWriter func(w io.Writer) (string, error)
+type layerWriter func(w io.Writer) (layerInfo, error)
 
 // byteCounter is a special io.Writer that counts all bytes written to
 // it and does nothing else.
@@ -365,7 +462,7 @@ func (b *byteCounter) Write(p []byte) (n int, err error) {
 //
 // The return value is the layer's SHA256 hash, which is used in the
 // image manifest.
-func uploadHashLayer(ctx context.Context, s *State, key string, mrating uint64, lw layerWriter) (*manifest.Entry, error) {
+func uploadHashLayer(ctx context.Context, s *State, key, contentType string, mrating uint64, lw layerWriter) (*manifest.Entry, error) {
 	s.UploadMutex.Lock(key)
 	defer s.UploadMutex.Unlock(key)
 
@@ -374,8 +471,8 @@ func uploadHashLayer(ctx context.Context, s *State, key string, mrating uint64,
 	}
 
 	path := "staging/" + key
-	var tarhash string
-	sha256sum, size, err := s.Storage.Persist(ctx, path, manifest.LayerType, func(sw io.Writer) (string, int64, error) {
+	var info layerInfo
+	sha256sum, size, err := s.Storage.Persist(ctx, path, contentType, func(sw io.Writer) (string, int64, error) {
 		// Sets up a "multiwriter" that simultaneously runs both hash
 		// algorithms and uploads to the storage backend.
 		shasum := sha256.New()
@@ -383,7 +480,7 @@ func uploadHashLayer(ctx context.Context, s *State, key string, mrating uint64,
 		multi := io.MultiWriter(sw, shasum, counter)
 
 		var err error
-		tarhash, err = lw(multi)
+		info, err = lw(multi)
 		sha256sum := fmt.Sprintf("%x", shasum.Sum([]byte{}))
 
 		return sha256sum, counter.count, err
@@ -409,8 +506,9 @@ func uploadHashLayer(ctx context.Context, s *State, key string, mrating uint64,
 	entry := manifest.Entry{
 		Digest:      "sha256:" + sha256sum,
 		Size:        size,
-		TarHash:     tarhash,
+		TarHash:     info.TarHash,
 		MergeRating: mrating,
+		Annotations: info.Annotations,
 	}
 
 	cacheLayer(ctx, s, key, entry)
@@ -419,8 +517,59 @@ func uploadHashLayer(ctx context.Context, s *State, key string, mrating uint64,
 }
 
 func BuildImage(ctx context.Context, s *State, image *Image) (*BuildResult, error) {
-	key := s.Cfg.Pkgs.CacheKey(image.Packages, image.Tag)
+	pkgs := s.Cfg.PkgSource(image.Source)
+	if pkgs == nil {
+		return nil, fmt.Errorf("unknown package source %q", image.Source)
+	}
+
+	if tc, ok := pkgs.(config.TagChecker); ok {
+		if err := tc.CheckTag(image.Tag); err != nil {
+			slog.Warn("rejecting image tag", "err", err, "image", image.Name, "tag", image.Tag)
+
+			return &BuildResult{
+				Error: "unknown_tag",
+			}, nil
+		}
+	}
+
+	// Moving targets are resolved once, so that the cache key, the
+	// build and the labels of the image refer to the same version
+	// of the package set.
+	if r, ok := pkgs.(config.Resolver); ok {
+		resolved, err := r.Resolve(image.Tag)
+		if err != nil {
+			slog.Warn("rejecting image tag", "err", err, "image", image.Name, "tag", image.Tag)
+
+			return &BuildResult{
+				Error: "unknown_tag",
+			}, nil
+		}
+
+		pkgs = resolved
+	}
+
+	key := pkgs.CacheKey(image.Packages, image.Tag)
+
+	// Keys of named sources are scoped to the source, as different
+	// sources may produce the same key for different package sets.
+	if key != "" && image.Source != "" {
+		key = fmt.Sprintf("%x", sha1.Sum([]byte(image.Source+"/"+key)))
+	}
+
+	// The nixpkgs configuration changes the package set, so builds
+	// are only cached for as long as it is unchanged.
+	if nixpkgsArgs := s.Cfg.NixpkgsArgs[image.Source]; key != "" && nixpkgsArgs != nil {
+		hash, err := nixpkgsArgs.Hash()
+		if err != nil {
+			slog.Warn("nixpkgs configuration can not be hashed, build is not cacheable", "err", err, "image", image.Name, "source", image.Source)
+			key = ""
+		} else {
+			key = fmt.Sprintf("%x", sha1.Sum([]byte(key+hash)))
+		}
+	}
+
 	if key != "" {
+		key = variantKey(key, image.Compression)
 		if m, c := manifestFromCache(ctx, s, key); c {
 			return &BuildResult{
 				Manifest: m,
@@ -428,7 +577,7 @@ func BuildImage(ctx context.Context, s *State, image *Image) (*BuildResult, erro
 		}
 	}
 
-	imageResult, err := prepareImage(s, image)
+	imageResult, err := prepareImage(s, image, pkgs)
 	if err != nil {
 		return nil, err
 	}
@@ -453,15 +602,23 @@ func BuildImage(ctx context.Context, s *State, image *Image) (*BuildResult, erro
 			cmd = "bash"
 		}
 	}
-	m, c := manifest.Manifest(image.Arch.imageArch, layers, cmd)
 
-	lw := func(w io.Writer) (string, error) {
+	// Package sources can describe the version of the package set
+	// that the image was built from.
+	var labels map[string]string
+	if l, ok := pkgs.(config.Labeler); ok {
+		labels = l.Labels(image.Tag)
+	}
+
+	m, c := manifest.Manifest(image.Arch.imageArch, layers, cmd, labels, image.Compression)
+
+	lw := func(w io.Writer) (layerInfo, error) {
 		r := bytes.NewReader(c.Config)
 		_, err := io.Copy(w, r)
-		return "", err
+		return layerInfo{}, err
 	}
 
-	if _, err = uploadHashLayer(ctx, s, c.SHA256, 0, lw); err != nil {
+	if _, err = uploadHashLayer(ctx, s, c.SHA256, manifest.LayerType, 0, lw); err != nil {
 		slog.Error("failed to upload config", "err", err, "image", image.Name, "tag", image.Tag)
 
 		return nil, err
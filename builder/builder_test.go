@@ -3,9 +3,23 @@
 package builder
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
-	"testing"
+	"github.com/google/nixery/config"
+	"github.com/google/nixery/layers"
+	"github.com/google/nixery/manifest"
+	"github.com/google/nixery/storage"
+	"github.com/im7mortal/kmutex"
 )
 
 var ignoreArch = cmpopts.IgnoreFields(Image{}, "Arch")
@@ -110,3 +124,187 @@ func TestImageFromNameShellArm64(t *testing.T) {
 		t.Fatal("Image(\"shell/arm64\"): Expected arch arm64")
 	}
 }
+
+func TestNixpkgsArgs(t *testing.T) {
+	cases := []struct {
+		args     *config.NixpkgsArgs
+		expected []string
+	}{
+		{nil, nil},
+		{
+			&config.NixpkgsArgs{Config: "/etc/nixery/config.nix"},
+			[]string{"--argstr", "nixpkgsConfig", "/etc/nixery/config.nix"},
+		},
+		{
+			&config.NixpkgsArgs{Overlays: []string{"/etc/nixery/a.nix", "/etc/nixery/b.nix"}},
+			[]string{"--argstr", "overlays", `["/etc/nixery/a.nix","/etc/nixery/b.nix"]`},
+		},
+	}
+
+	for _, c := range cases {
+		if diff := cmp.Diff(c.expected, nixpkgsArgs(c.args)); diff != "" {
+			t.Errorf("unexpected arguments for %+v:\n%s", c.args, diff)
+		}
+	}
+}
+
+// slowBackend delays uploads to the staging area, so that layers finish
+// uploading in a different order than they were started in.
+type slowBackend struct {
+	*storage.FSBackend
+	delay func(path string) time.Duration
+}
+
+func (b *slowBackend) Persist(ctx context.Context, path, contentType string, f storage.Persister) (string, int64, error) {
+	select {
+	case <-time.After(b.delay(path)):
+	case <-ctx.Done():
+		return "", 0, ctx.Err()
+	}
+
+	return b.FSBackend.Persist(ctx, path, contentType, f)
+}
+
+// failingBackend fails the upload of one layer, and blocks all other
+// uploads until they are cancelled.
+type failingBackend struct {
+	*storage.FSBackend
+	fail      string
+	cancelled chan string
+}
+
+var errUpload = errors.New("upload failed")
+
+func (b *failingBackend) Persist(ctx context.Context, path, contentType string, f storage.Persister) (string, int64, error) {
+	if path == "staging/"+b.fail {
+		return "", 0, errUpload
+	}
+
+	select {
+	case <-ctx.Done():
+		b.cancelled <- path
+		return "", 0, ctx.Err()
+	case <-time.After(10 * time.Second):
+		return "", 0, fmt.Errorf("upload of %s was not cancelled", path)
+	}
+}
+
+// testLayerState creates a state with the given storage backend and a
+// build result with several independent store paths.
+func testLayerState(t *testing.T, wrap func(*storage.FSBackend) storage.Backend) (*State, *ImageResult) {
+	dir := t.TempDir()
+	t.Setenv("STORAGE_PATH", filepath.Join(dir, "storage"))
+
+	fs, err := storage.NewFSBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := NewCache(filepath.Join(dir, "cache"), fs.Name(), 1<<20, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cache.db.Close() })
+
+	var result ImageResult
+	// Distinct sizes keep the order of grouped layers stable.
+	for i, name := range []string{"hello", "git", "htop", "curl", "jq"} {
+		p := filepath.Join(dir, "store", name)
+		writeTestPath(t, p, time.Unix(1, 0), 0644)
+
+		result.Graph.References.Graph = append(result.Graph.References.Graph, p)
+		result.Graph.Graph = append(result.Graph.Graph, struct {
+			Size uint64   `json:"closureSize"`
+			Path string   `json:"path"`
+			Refs []string `json:"references"`
+		}{Size: uint64(100 * (i + 1)), Path: p})
+	}
+
+	symlinks := filepath.Join(dir, "symlinks.tar")
+	if err := os.WriteFile(symlinks, []byte("symlink layer"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	result.SymlinkLayer.Path = symlinks
+	result.SymlinkLayer.TarHash = "symlinks"
+
+	return &State{
+		Storage:     wrap(fs),
+		Cache:       cache,
+		Cfg:         config.Config{Workers: 3},
+		UploadMutex: kmutex.New(),
+	}, &result
+}
+
+func TestPrepareLayersOrder(t *testing.T) {
+	s, result := testLayerState(t, func(fs *storage.FSBackend) storage.Backend {
+		// Layers started first finish last.
+		var started atomic.Int64
+		return &slowBackend{fs, func(path string) time.Duration {
+			if !strings.HasPrefix(path, "staging/") {
+				return 0
+			}
+
+			return time.Duration(10-started.Add(1)) * 10 * time.Millisecond
+		}}
+	})
+
+	image := ImageFromName("hello", "latest")
+	entries, err := prepareLayers(context.Background(), s, &image, result)
+	if err != nil {
+		t.Fatalf("failed to prepare layers: %s", err)
+	}
+
+	grouped := layers.GroupLayers(&result.Graph, &s.Pop, LayerBudget)
+	if len(grouped) < 2 {
+		t.Fatalf("test graph was grouped into only %d layers", len(grouped))
+	}
+
+	var expected, actual []string
+	for _, l := range grouped {
+		var pkgs []string
+		for _, p := range l.Contents {
+			pkgs = append(pkgs, layers.PackageFromPath(p))
+		}
+		expected = append(expected, "nixery: "+strings.Join(pkgs, " "))
+	}
+	expected = append(expected, "nixery: symlink layer for hello")
+
+	for _, e := range entries {
+		actual = append(actual, e.CreatedBy)
+		if e.Digest == "" {
+			t.Errorf("entry %q has no digest", e.CreatedBy)
+		}
+	}
+
+	if diff := cmp.Diff(expected, actual); diff != "" {
+		t.Errorf("entries are not in slot order:\n%s", diff)
+	}
+}
+
+func TestPrepareLayersError(t *testing.T) {
+	var backend *failingBackend
+	s, result := testLayerState(t, func(fs *storage.FSBackend) storage.Backend {
+		backend = &failingBackend{
+			FSBackend: fs,
+			fail:      variantKey("symlinks", manifest.Gzip),
+			cancelled: make(chan string, 10),
+		}
+		return backend
+	})
+
+	// All uploads run at once, so that the failing upload does not
+	// wait for the blocked ones.
+	s.Cfg.Workers = 8
+
+	image := ImageFromName("hello", "latest")
+	_, err := prepareLayers(context.Background(), s, &image, result)
+	if !errors.Is(err, errUpload) {
+		t.Fatalf("upload error was not returned: %v", err)
+	}
+
+	grouped := layers.GroupLayers(&result.Graph, &s.Pop, LayerBudget)
+	close(backend.cancelled)
+	if cancelled := len(backend.cancelled); cancelled != len(grouped) {
+		t.Errorf("%d of %d remaining uploads were cancelled", cancelled, len(grouped))
+	}
+}
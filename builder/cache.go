@@ -4,81 +4,501 @@ package builder
 
 import (
 	"bytes"
+	"container/list"
 	"context"
+	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/nixery/manifest"
+	"github.com/google/nixery/storage"
+	bolt "go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
 	"log/slog"
 )
 
+// Names of the buckets in the local cache index.
+var (
+	metaBucket     = []byte("meta")
+	layerBucket    = []byte("layers")
+	manifestBucket = []byte("manifests")
+
+	// Last access time of each manifest on disk, used for
+	// evicting the least recently used manifests.
+	accessBucket = []byte("manifest-access")
+)
+
+// CacheStats contains statistics about the manifest cache tiers.
+type CacheStats struct {
+	MemoryHits    uint64 `json:"memoryHits"`
+	MemoryEntries int    `json:"memoryEntries"`
+	MemoryBytes   int64  `json:"memoryBytes"`
+
+	DiskHits    uint64 `json:"diskHits"`
+	DiskEntries int    `json:"diskEntries"`
+	DiskBytes   int64  `json:"diskBytes"`
+
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+// manifestLRU is a size-bounded in-memory cache of the most recently
+// used manifests.
+type manifestLRU struct {
+	limit int64
+	size  int64
+	order *list.List // most recently used at the front
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	key string
+	m   json.RawMessage
+}
+
+func newManifestLRU(limit int64) *manifestLRU {
+	return &manifestLRU{
+		limit: limit,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (l *manifestLRU) get(key string) (json.RawMessage, bool) {
+	e, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	l.order.MoveToFront(e)
+	return e.Value.(*lruEntry).m, true
+}
+
+func (l *manifestLRU) remove(key string) {
+	if e, ok := l.items[key]; ok {
+		l.size -= int64(len(e.Value.(*lruEntry).m))
+		l.order.Remove(e)
+		delete(l.items, key)
+	}
+}
+
+// add inserts a manifest and evicts the least recently used manifests
+// until the cache fits into its limit. It returns the number of
+// evicted manifests.
+func (l *manifestLRU) add(key string, m json.RawMessage) (evicted int) {
+	l.remove(key)
+
+	// Manifests that are larger than the entire cache are only
+	// kept on disk.
+	if int64(len(m)) > l.limit {
+		return 0
+	}
+
+	l.items[key] = l.order.PushFront(&lruEntry{key, m})
+	l.size += int64(len(m))
+
+	for l.size > l.limit {
+		oldest := l.order.Back()
+		entry := oldest.Value.(*lruEntry)
+		l.order.Remove(oldest)
+		delete(l.items, entry.key)
+		l.size -= int64(len(entry.m))
+		evicted++
+	}
+
+	return evicted
+}
+
 // LocalCache implements the structure used for local caching of
 // manifests and layer uploads.
+//
+// Layer builds and manifests are persisted in an embedded key/value
+// database, which allows cached images to be served without
+// round-trips to the storage backend after a restart.
+//
+// Manifests are kept in two size-bounded tiers: The most recently
+// used ones in memory, backed by the on-disk index.
 type LocalCache struct {
+	db *bolt.DB
+
 	// Manifest cache
-	mmtx sync.RWMutex
-	mdir string
+	mmtx      sync.Mutex
+	mcache    *manifestLRU
+	diskLimit int64
+	diskSize  int64
+
+	// Manifest access times not yet written to disk, and times at
+	// which manifests were last validated against the backend
+	amtx     sync.Mutex
+	accessed map[string]time.Time
+	checked  map[string]time.Time
+
+	memoryHits atomic.Uint64
+	diskHits   atomic.Uint64
+	misses     atomic.Uint64
+	evictions  atomic.Uint64
 
 	// Layer cache
 	lmtx   sync.RWMutex
 	lcache map[string]manifest.Entry
+	lused  map[string]time.Time // last recorded use of layer builds
 }
 
-// Creates an in-memory cache and ensures that the local file path for
-// manifest caching exists.
-func NewCache() (LocalCache, error) {
-	path := os.TempDir() + "/nixery"
+// Opens the local cache index in the specified directory and loads
+// all known layer builds into memory.
+//
+// Manifests are cached up to the given number of bytes in memory and
+// on disk respectively.
+//
+// The index is tied to the storage backend it was populated from. If
+// Nixery is started with a different backend, the index is discarded
+// as its entries might not be present in the new backend.
+func NewCache(path, backend string, memoryLimit, diskLimit int64) (*LocalCache, error) {
 	err := os.MkdirAll(path, 0755)
 	if err != nil {
-		return LocalCache{}, err
+		return nil, err
+	}
+
+	db, err := bolt.Open(filepath.Join(path, "index.db"), 0644, &bolt.Options{
+		Timeout: 5 * time.Second,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cache index: %w", err)
+	}
+
+	lcache := make(map[string]manifest.Entry)
+	var diskSize int64
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+
+		if b := meta.Get([]byte("backend")); b != nil && string(b) != backend {
+			slog.Warn("storage backend changed, discarding cache index", "previous", string(b), "backend", backend)
+
+			for _, name := range [][]byte{layerBucket, manifestBucket, accessBucket} {
+				if err := tx.DeleteBucket(name); err != nil && err != berrors.ErrBucketNotFound {
+					return err
+				}
+			}
+		}
+
+		if err := meta.Put([]byte("backend"), []byte(backend)); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(accessBucket); err != nil {
+			return err
+		}
+
+		manifests, err := tx.CreateBucketIfNotExists(manifestBucket)
+		if err != nil {
+			return err
+		}
+
+		err = manifests.ForEach(func(k, v []byte) error {
+			diskSize += int64(len(v))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		layers, err := tx.CreateBucketIfNotExists(layerBucket)
+		if err != nil {
+			return err
+		}
+
+		return layers.ForEach(func(k, v []byte) error {
+			var entry manifest.Entry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				slog.Warn("skipping invalid layer in cache index", "err", err, "layer", string(k))
+				return nil
+			}
+
+			lcache[string(k)] = entry
+			return nil
+		})
+	})
+
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to load cache index: %w", err)
+	}
+
+	slog.Info("loaded local cache index", "path", path, "layers", len(lcache), "manifestBytes", diskSize)
+
+	c := &LocalCache{
+		db:        db,
+		mcache:    newManifestLRU(memoryLimit),
+		diskLimit: diskLimit,
+		diskSize:  diskSize,
+		accessed:  make(map[string]time.Time),
+		checked:   make(map[string]time.Time),
+		lcache:    lcache,
+		lused:     make(map[string]time.Time),
+	}
+
+	// The limit might have been lowered since the last start.
+	if err := c.evictManifests(); err != nil {
+		slog.Error("failed to evict manifests from local cache", "err", err)
+	}
+
+	return c, nil
+}
+
+// Stats returns hit/miss statistics of the manifest cache.
+func (c *LocalCache) Stats() CacheStats {
+	c.mmtx.Lock()
+	defer c.mmtx.Unlock()
+
+	stats := CacheStats{
+		MemoryHits:    c.memoryHits.Load(),
+		MemoryEntries: len(c.mcache.items),
+		MemoryBytes:   c.mcache.size,
+		DiskHits:      c.diskHits.Load(),
+		DiskBytes:     c.diskSize,
+		Misses:        c.misses.Load(),
+		Evictions:     c.evictions.Load(),
+	}
+
+	c.db.View(func(tx *bolt.Tx) error {
+		stats.DiskEntries = tx.Bucket(manifestBucket).Stats().KeyN
+		return nil
+	})
+
+	return stats
+}
+
+// evictManifests removes the least recently used manifests from disk
+// until the on-disk tier fits into its size limit. The caller must
+// hold the manifest lock.
+func (c *LocalCache) evictManifests() error {
+	if c.diskSize <= c.diskLimit {
+		return nil
+	}
+
+	var freed int64
+	var evicted uint64
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		manifests := tx.Bucket(manifestBucket)
+		access := tx.Bucket(accessBucket)
+
+		if err := c.writeAccessTimes(tx); err != nil {
+			return err
+		}
+
+		type accessed struct {
+			key  string
+			time int64
+		}
+
+		var keys []accessed
+		err := manifests.ForEach(func(k, _ []byte) error {
+			var t int64
+			if v := access.Get(k); len(v) == 8 {
+				t = int64(binary.BigEndian.Uint64(v))
+			}
+
+			keys = append(keys, accessed{string(k), t})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].time < keys[j].time
+		})
+
+		for _, k := range keys {
+			if c.diskSize-freed <= c.diskLimit {
+				break
+			}
+
+			freed += int64(len(manifests.Get([]byte(k.key))))
+			if err := manifests.Delete([]byte(k.key)); err != nil {
+				return err
+			}
+			if err := access.Delete([]byte(k.key)); err != nil {
+				return err
+			}
+
+			evicted++
+			slog.Debug("evicted manifest from local cache", "manifest", k.key)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	c.diskSize -= freed
+	c.evictions.Add(evicted)
+	return nil
+}
+
+// accessFlushSize is the number of manifest accesses that are
+// collected in memory before their times are written to disk.
+const accessFlushSize = 128
+
+// touchManifest records the current time as the last access time of a
+// manifest. Access times are kept in memory and written to disk in
+// batches, so that reading a manifest does not require a write
+// transaction. It reports whether a batch should be flushed.
+func (c *LocalCache) touchManifest(key string) bool {
+	c.amtx.Lock()
+	defer c.amtx.Unlock()
+
+	c.accessed[key] = time.Now()
+	return len(c.accessed) >= accessFlushSize
+}
+
+// writeAccessTimes moves the access times collected in memory into
+// the given transaction. Times of manifests that have been removed in
+// the meantime are dropped.
+func (c *LocalCache) writeAccessTimes(tx *bolt.Tx) error {
+	c.amtx.Lock()
+	accessed := c.accessed
+	c.accessed = make(map[string]time.Time)
+	c.amtx.Unlock()
+
+	manifests := tx.Bucket(manifestBucket)
+	access := tx.Bucket(accessBucket)
+	for key, at := range accessed {
+		if manifests.Get([]byte(key)) == nil {
+			continue
+		}
+
+		t := make([]byte, 8)
+		binary.BigEndian.PutUint64(t, uint64(at.UnixNano()))
+		if err := access.Put([]byte(key), t); err != nil {
+			return err
+		}
 	}
 
-	return LocalCache{
-		mdir:   path + "/",
-		lcache: make(map[string]manifest.Entry),
-	}, nil
+	return nil
+}
+
+// flushAccessTimes writes the access times collected in memory to
+// disk. It does not require the manifest lock.
+func (c *LocalCache) flushAccessTimes() {
+	if err := c.db.Update(c.writeAccessTimes); err != nil {
+		slog.Error("failed to record manifest access times in local cache", "err", err)
+	}
+}
+
+// manifestCheckDue reports whether a locally cached manifest should be
+// validated against the storage backend, and assumes that it will be.
+func (c *LocalCache) manifestCheckDue(key string, grace time.Duration) bool {
+	if grace <= 0 {
+		return false
+	}
+
+	c.amtx.Lock()
+	defer c.amtx.Unlock()
+
+	if time.Since(c.checked[key]) < grace/2 {
+		return false
+	}
+
+	c.checked[key] = time.Now()
+	return true
 }
 
 // Retrieve a cached manifest if the build is cacheable and it exists.
+// The in-memory tier is checked before the on-disk tier.
 func (c *LocalCache) manifestFromLocalCache(key string) (json.RawMessage, bool) {
-	c.mmtx.RLock()
-	defer c.mmtx.RUnlock()
+	m, ok := c.manifestFromTiers(key)
+	if ok && c.touchManifest(key) {
+		c.flushAccessTimes()
+	}
 
-	f, err := os.Open(c.mdir + key)
-	if err != nil {
-		// This is a debug log statement because failure to
-		// read the manifest key is currently expected if it
-		// is not cached.
-		slog.Debug("failed to read manifest from local cache", "err", err, "manifest", key)
+	return m, ok
+}
 
-		return nil, false
+func (c *LocalCache) manifestFromTiers(key string) (json.RawMessage, bool) {
+	c.mmtx.Lock()
+	defer c.mmtx.Unlock()
+
+	if m, ok := c.mcache.get(key); ok {
+		c.memoryHits.Add(1)
+		return m, true
 	}
-	defer f.Close()
 
-	m, err := io.ReadAll(f)
+	var m []byte
+	err := c.db.View(func(tx *bolt.Tx) error {
+		// Values are only valid during the transaction and
+		// need to be copied.
+		if v := tx.Bucket(manifestBucket).Get([]byte(key)); v != nil {
+			m = bytes.Clone(v)
+		}
+
+		return nil
+	})
+
 	if err != nil {
 		slog.Error("failed to read manifest from local cache", "err", err, "manifest", key)
+	}
 
+	if m == nil {
+		c.misses.Add(1)
 		return nil, false
 	}
 
+	c.diskHits.Add(1)
+	c.evictions.Add(uint64(c.mcache.add(key, m)))
+
 	return json.RawMessage(m), true
 }
 
 // Adds the result of a manifest build to the local cache, if the
 // manifest is considered cacheable.
-//
-// Manifests can be quite large and are cached on disk instead of in
-// memory.
 func (c *LocalCache) localCacheManifest(key string, m json.RawMessage) {
 	c.mmtx.Lock()
 	defer c.mmtx.Unlock()
 
-	err := os.WriteFile(c.mdir+key, []byte(m), 0644)
+	c.evictions.Add(uint64(c.mcache.add(key, m)))
+	c.touchManifest(key)
+
+	// Manifests are added after being read from or written to the
+	// storage backend, which validates them.
+	c.amtx.Lock()
+	c.checked[key] = time.Now()
+	c.amtx.Unlock()
+
+	var delta int64
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		manifests := tx.Bucket(manifestBucket)
+		delta = int64(len(m) - len(manifests.Get([]byte(key))))
+
+		if err := manifests.Put([]byte(key), m); err != nil {
+			return err
+		}
+
+		return c.writeAccessTimes(tx)
+	})
+
 	if err != nil {
 		slog.Error("failed to locally cache manifest", "err", err, "manifest", key)
+		return
+	}
+
+	c.diskSize += delta
+
+	if err := c.evictManifests(); err != nil {
+		slog.Error("failed to evict manifests from local cache", "err", err)
 	}
 }
 
@@ -96,13 +516,43 @@ func (c *LocalCache) localCacheLayer(key string, e manifest.Entry) {
 	c.lmtx.Lock()
 	c.lcache[key] = e
 	c.lmtx.Unlock()
+
+	j, _ := json.Marshal(&e)
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(layerBucket).Put([]byte(key), j)
+	})
+
+	if err != nil {
+		slog.Error("failed to persist layer in local cache index", "err", err, "layer", key)
+	}
 }
 
 // Retrieve a manifest from the cache(s). First the local cache is
 // checked, then the storage backend.
+//
+// Locally cached manifests are validated against the storage backend
+// at least twice per garbage collection grace period, as they might
+// have expired on another instance.
 func manifestFromCache(ctx context.Context, s *State, key string) (json.RawMessage, bool) {
 	if m, cached := s.Cache.manifestFromLocalCache(key); cached {
-		return m, true
+		if !s.Cache.manifestCheckDue(key, s.Cfg.GCGrace) {
+			return m, true
+		}
+
+		_, err := s.Storage.Stat(ctx, "manifests/"+key)
+		if err == nil {
+			return m, true
+		}
+
+		if !storage.IsNotFound(err) {
+			slog.Warn("failed to validate locally cached manifest", "err", err, "manifest", key, "backend", s.Storage.Name())
+			return m, true
+		}
+
+		slog.Info("locally cached manifest has expired", "manifest", key)
+		s.Cache.forgetManifest(key)
+
+		return nil, false
 	}
 
 	r, err := s.Storage.Fetch(ctx, "manifests/"+key)
@@ -147,8 +597,27 @@ func cacheManifest(ctx context.Context, s *State, key string, m json.RawMessage)
 
 // Retrieve a layer build from the cache, first checking the local
 // cache followed by the bucket cache.
+//
+// The use of a layer build is recorded in the storage backend, so that
+// garbage collection keeps builds that are still in use. Locally
+// cached builds are validated against the storage backend when their
+// use is recorded, as they might have been collected by another
+// instance.
 func layerFromCache(ctx context.Context, s *State, key string) (*manifest.Entry, bool) {
 	if entry, cached := s.Cache.layerFromLocalCache(key); cached {
+		if !s.Cache.layerUseDue(key, s.Cfg.GCGrace) {
+			return entry, true
+		}
+
+		digest := strings.TrimPrefix(entry.Digest, "sha256:")
+		if _, err := s.Storage.Stat(ctx, "layers/"+digest); err != nil {
+			slog.Warn("locally cached layer is missing from storage backend", "err", err, "layer", key, "backend", s.Storage.Name())
+			s.Cache.forgetLayer(key)
+
+			return nil, false
+		}
+
+		persistBuild(ctx, s, key, *entry)
 		return entry, true
 	}
 
@@ -176,6 +645,10 @@ func layerFromCache(ctx context.Context, s *State, key string) (*manifest.Entry,
 		return nil, false
 	}
 
+	if s.Cache.layerUseDue(key, s.Cfg.GCGrace) {
+		persistBuild(ctx, s, key, entry)
+	}
+
 	go s.Cache.localCacheLayer(key, entry)
 	return &entry, true
 }
@@ -183,6 +656,14 @@ func layerFromCache(ctx context.Context, s *State, key string) (*manifest.Entry,
 func cacheLayer(ctx context.Context, s *State, key string, entry manifest.Entry) {
 	s.Cache.localCacheLayer(key, entry)
 
+	// Persisting the build records its first use.
+	s.Cache.layerUseDue(key, s.Cfg.GCGrace)
+	persistBuild(ctx, s, key, entry)
+}
+
+// persistBuild writes a layer build to the storage backend. Builds are
+// rewritten when they are used, which updates their modification time.
+func persistBuild(ctx context.Context, s *State, key string, entry manifest.Entry) {
 	j, _ := json.Marshal(&entry)
 	path := "builds/" + key
 	_, _, err := s.Storage.Persist(ctx, path, "", func(w io.Writer) (string, int64, error) {
@@ -193,6 +674,71 @@ func cacheLayer(ctx context.Context, s *State, key string, entry manifest.Entry)
 	if err != nil {
 		slog.Error("failed to cache layer", "err", err, "layer", key, "backend", s.Storage.Name())
 	}
+}
+
+// layerUseDue reports whether the use of a layer build should be
+// recorded in the storage backend, and assumes that it will be. Uses
+// are recorded at least twice per garbage collection grace period.
+func (c *LocalCache) layerUseDue(key string, grace time.Duration) bool {
+	if grace <= 0 {
+		return false
+	}
+
+	c.lmtx.Lock()
+	defer c.lmtx.Unlock()
+
+	if time.Since(c.lused[key]) < grace/2 {
+		return false
+	}
+
+	c.lused[key] = time.Now()
+	return true
+}
+
+// Remove a layer build from the local cache, for example after it
+// has been garbage collected from the storage backend.
+func (c *LocalCache) forgetLayer(key string) {
+	c.lmtx.Lock()
+	delete(c.lcache, key)
+	delete(c.lused, key)
+	c.lmtx.Unlock()
+
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(layerBucket).Delete([]byte(key))
+	})
+
+	if err != nil {
+		slog.Error("failed to remove layer from local cache index", "err", err, "layer", key)
+	}
+}
+
+// Remove a manifest from both tiers of the local cache.
+func (c *LocalCache) forgetManifest(key string) {
+	c.mmtx.Lock()
+	defer c.mmtx.Unlock()
+
+	c.mcache.remove(key)
+
+	c.amtx.Lock()
+	delete(c.checked, key)
+	c.amtx.Unlock()
+
+	var freed int64
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		manifests := tx.Bucket(manifestBucket)
+		freed = int64(len(manifests.Get([]byte(key))))
+
+		if err := manifests.Delete([]byte(key)); err != nil {
+			return err
+		}
+
+		return tx.Bucket(accessBucket).Delete([]byte(key))
+	})
+
+	if err != nil {
+		slog.Error("failed to remove manifest from local cache index", "err", err, "manifest", key)
+		return
+	}
 
-	return
+	c.diskSize -= freed
 }
@@ -0,0 +1,126 @@
+// Copyright The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nixery/manifest"
+)
+
+func TestCacheIndexSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	cache, err := NewCache(dir, "test", 1<<20, 1<<20)
+	if err != nil {
+		t.Fatalf("failed to open cache: %s", err)
+	}
+
+	entry := manifest.Entry{
+		Digest:  "sha256:aaaa",
+		Size:    42,
+		TarHash: "sha256:bbbb",
+	}
+	cache.localCacheLayer("layer", entry)
+	cache.localCacheManifest("manifest", []byte(`{"schemaVersion":2}`))
+	cache.db.Close()
+
+	cache, err = NewCache(dir, "test", 1<<20, 1<<20)
+	if err != nil {
+		t.Fatalf("failed to reopen cache: %s", err)
+	}
+	defer cache.db.Close()
+
+	cached, ok := cache.layerFromLocalCache("layer")
+	if !ok {
+		t.Fatal("layer was not loaded from cache index")
+	}
+
+	if diff := cmp.Diff(entry, *cached); diff != "" {
+		t.Fatalf("cached layer mismatch:\n%s", diff)
+	}
+
+	m, ok := cache.manifestFromLocalCache("manifest")
+	if !ok || string(m) != `{"schemaVersion":2}` {
+		t.Fatalf("manifest was not loaded from cache index: %q", m)
+	}
+}
+
+func TestCacheIndexBackendChange(t *testing.T) {
+	dir := t.TempDir()
+
+	cache, err := NewCache(dir, "first", 1<<20, 1<<20)
+	if err != nil {
+		t.Fatalf("failed to open cache: %s", err)
+	}
+
+	cache.localCacheLayer("layer", manifest.Entry{Digest: "sha256:aaaa"})
+	cache.localCacheManifest("manifest", []byte("{}"))
+	cache.db.Close()
+
+	cache, err = NewCache(dir, "second", 1<<20, 1<<20)
+	if err != nil {
+		t.Fatalf("failed to reopen cache: %s", err)
+	}
+	defer cache.db.Close()
+
+	if _, ok := cache.layerFromLocalCache("layer"); ok {
+		t.Error("layer from previous backend was not discarded")
+	}
+
+	if _, ok := cache.manifestFromLocalCache("manifest"); ok {
+		t.Error("manifest from previous backend was not discarded")
+	}
+}
+
+func TestManifestCacheEviction(t *testing.T) {
+	m := func(c byte) []byte {
+		return bytes.Repeat([]byte{c}, 100)
+	}
+
+	// Two manifests fit into memory, three on disk.
+	cache, err := NewCache(t.TempDir(), "test", 200, 300)
+	if err != nil {
+		t.Fatalf("failed to open cache: %s", err)
+	}
+	defer cache.db.Close()
+
+	cache.localCacheManifest("a", m('a'))
+	cache.localCacheManifest("b", m('b'))
+	cache.localCacheManifest("c", m('c'))
+
+	// "a" has been evicted from memory, but is still on disk.
+	if _, ok := cache.manifestFromLocalCache("a"); !ok {
+		t.Fatal("manifest a was evicted from disk too early")
+	}
+
+	// Accessing "a" made "b" the least recently used manifest on
+	// disk, which is evicted once "d" is added.
+	cache.localCacheManifest("d", m('d'))
+
+	stats := cache.Stats()
+	if stats.DiskBytes != 300 || stats.DiskEntries != 3 {
+		t.Errorf("unexpected disk usage: %d bytes in %d entries", stats.DiskBytes, stats.DiskEntries)
+	}
+
+	if stats.MemoryBytes != 200 || stats.MemoryEntries != 2 {
+		t.Errorf("unexpected memory usage: %d bytes in %d entries", stats.MemoryBytes, stats.MemoryEntries)
+	}
+
+	if _, ok := cache.manifestFromLocalCache("b"); ok {
+		t.Error("least recently used manifest b was not evicted")
+	}
+
+	for _, key := range []string{"a", "c", "d"} {
+		if _, ok := cache.manifestFromLocalCache(key); !ok {
+			t.Errorf("manifest %s was evicted unexpectedly", key)
+		}
+	}
+
+	stats = cache.Stats()
+	if stats.Misses != 1 || stats.DiskHits+stats.MemoryHits != 4 {
+		t.Errorf("unexpected hit statistics: %+v", stats)
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the creation of eStargz layers, which can be
+// pulled lazily by supporting snapshotters.
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/google/nixery/layers"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// packEstargz creates an eStargz layer from the paths in the list and
+// writes it to the supplied writer.
+//
+// eStargz layers are valid gzip-compressed tarballs, but contain a
+// table of contents which allows snapshotters to lazily fetch
+// individual files. The executables of each store path are
+// prioritised, as they are likely to be accessed when a container
+// starts.
+//
+// Building the table of contents requires random access to the
+// tarball, so it is first written to a temporary file.
+func packEstargz(l *layers.Layer, w io.Writer) (layerInfo, error) {
+	tmp, err := os.CreateTemp("", "nixery-layer-*.tar")
+	if err != nil {
+		return layerInfo{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := writeStorePaths(l, tmp); err != nil {
+		return layerInfo{}, err
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return layerInfo{}, err
+	}
+
+	var prioritised []string
+	for _, path := range l.Contents {
+		bins, _ := filepath.Glob(filepath.Join(path, "bin", "*"))
+		prioritised = append(prioritised, bins...)
+	}
+
+	var missing []string
+	blob, err := estargz.Build(io.NewSectionReader(tmp, 0, size),
+		estargz.WithCompression(newEstargzCompression()),
+		estargz.WithPrioritizedFiles(prioritised),
+		estargz.WithAllowPrioritizeNotFound(&missing),
+	)
+	if err != nil {
+		return layerInfo{}, err
+	}
+	defer blob.Close()
+
+	if _, err := io.Copy(w, blob); err != nil {
+		return layerInfo{}, err
+	}
+
+	// The diff ID is only available after closing the blob.
+	if err := blob.Close(); err != nil {
+		return layerInfo{}, err
+	}
+
+	uncompressed, err := blob.UncompressedSize()
+	if err != nil {
+		return layerInfo{}, err
+	}
+
+	return layerInfo{
+		TarHash: blob.DiffID().String(),
+		Annotations: map[string]string{
+			estargz.TOCJSONDigestAnnotation:         blob.TOCDigest().String(),
+			estargz.StoreUncompressedSizeAnnotation: strconv.FormatInt(uncompressed, 10),
+		},
+	}, nil
+}
+
+// estargzCompressor writes the gzip-compressed chunks of an eStargz
+// layer, as well as its table of contents and footer.
+//
+// This is equivalent to the compressor in the estargz library, except
+// for the footer. The library relies on compress/gzip to produce an
+// empty stored block for the footer, which newer Go versions no
+// longer emit, so the footer is assembled manually instead.
+type estargzCompressor struct {
+	*estargz.GzipCompressor
+	*estargz.GzipDecompressor
+}
+
+func newEstargzCompression() estargz.Compression {
+	return &estargzCompressor{
+		estargz.NewGzipCompressorWithLevel(gzip.DefaultCompression),
+		&estargz.GzipDecompressor{},
+	}
+}
+
+func (c *estargzCompressor) WriteTOCAndFooter(w io.Writer, off int64, toc *estargz.JTOC, diffHash hash.Hash) (digest.Digest, error) {
+	tocJSON, err := json.MarshalIndent(toc, "", "\t")
+	if err != nil {
+		return "", err
+	}
+
+	gz, err := gzip.NewWriterLevel(w, gzip.DefaultCompression)
+	if err != nil {
+		return "", err
+	}
+
+	gw := io.Writer(gz)
+	if diffHash != nil {
+		gw = io.MultiWriter(gz, diffHash)
+	}
+
+	tw := tar.NewWriter(gw)
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     estargz.TOCTarName,
+		Size:     int64(len(tocJSON)),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := tw.Write(tocJSON); err != nil {
+		return "", err
+	}
+
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+
+	if _, err := w.Write(estargzFooter(off)); err != nil {
+		return "", err
+	}
+
+	return digest.FromBytes(tocJSON), nil
+}
+
+// estargzFooter returns the footer of an eStargz layer, which is an
+// empty gzip member with the offset of the table of contents in its
+// extra header field (see RFC 1952, section 2.3.1.1).
+func estargzFooter(tocOff int64) []byte {
+	subfield := fmt.Sprintf("%016xSTARGZ", tocOff)
+
+	var buf bytes.Buffer
+	buf.Write([]byte{
+		0x1f, 0x8b, // magic
+		0x08,       // deflate
+		0x04,       // FEXTRA
+		0, 0, 0, 0, // mtime
+		0x00, // extra flags
+		0xff, // unknown OS
+	})
+	binary.Write(&buf, binary.LittleEndian, uint16(4+len(subfield)))
+	buf.Write([]byte{'S', 'G'})
+	binary.Write(&buf, binary.LittleEndian, uint16(len(subfield)))
+	buf.WriteString(subfield)
+
+	// Final, empty stored deflate block
+	buf.Write([]byte{0x01, 0x00, 0x00, 0xff, 0xff})
+
+	// CRC32 and size of the (empty) uncompressed data
+	binary.Write(&buf, binary.LittleEndian, crc32.ChecksumIEEE(nil))
+	binary.Write(&buf, binary.LittleEndian, uint32(0))
+
+	return buf.Bytes()
+}
@@ -0,0 +1,397 @@
+// Copyright The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements garbage collection of objects in the storage
+// backend that are no longer referenced by any manifest or layer
+// build.
+//
+// Collection is a simple mark-and-sweep: Cached manifests, recent
+// manifests of uncacheable images and recently used layer builds form
+// the roots, and every blob they reference is live. Everything else
+// that is older than the grace period is deleted.
+//
+// Garbage collection only removes collected layer builds from the
+// local cache of the instance running it. Other instances sharing the
+// storage backend validate their local entries when recording their
+// use, see layerFromCache.
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/google/nixery/manifest"
+	"github.com/google/nixery/storage"
+)
+
+// GCOptions configures a garbage collection run.
+type GCOptions struct {
+	// Objects younger than this are never deleted, which protects
+	// builds and uploads that are in progress.
+	Grace time.Duration
+
+	// Cached manifests older than this are deleted, releasing the
+	// layers they reference. Zero keeps manifests forever.
+	ManifestTTL time.Duration
+
+	// Only report which objects would be deleted.
+	DryRun bool
+}
+
+// GCReport describes the result of a garbage collection run.
+type GCReport struct {
+	DryRun  bool                 `json:"dryRun"`
+	Live    int                  `json:"live"`
+	Deleted []storage.ObjectInfo `json:"deleted"`
+	Freed   int64                `json:"freed"`
+}
+
+// gcRun holds the state of a single garbage collection run.
+type gcRun struct {
+	s      *State
+	remote storage.Backend // reads bypass local caches
+	opts   GCOptions
+	now    time.Time
+	live   map[string]bool
+	report GCReport
+}
+
+// CollectGarbage deletes unreferenced blobs, layer builds, cached
+// manifests and stale staging objects from the storage backend.
+//
+// Layer builds are kept while they have been used within the grace
+// period or are referenced by a cached manifest, as uncacheable images
+// are only reachable through them. Blobs are kept while they are
+// younger than the grace period or referenced by a kept manifest or
+// layer build.
+func CollectGarbage(ctx context.Context, s *State, opts GCOptions) (*GCReport, error) {
+	gc := &gcRun{
+		s:      s,
+		remote: storage.Uncached(s.Storage),
+		opts:   opts,
+		now:    time.Now(),
+		live:   make(map[string]bool),
+		report: GCReport{DryRun: opts.DryRun},
+	}
+
+	if err := gc.markManifests(ctx); err != nil {
+		return nil, fmt.Errorf("failed to mark cached manifests: %w", err)
+	}
+
+	if err := gc.markTombstones(ctx); err != nil {
+		return nil, fmt.Errorf("failed to mark expired manifests: %w", err)
+	}
+
+	if err := gc.markBlobManifests(ctx); err != nil {
+		return nil, fmt.Errorf("failed to mark manifests of uncacheable images: %w", err)
+	}
+
+	if err := gc.sweepBuilds(ctx); err != nil {
+		return nil, fmt.Errorf("failed to sweep layer builds: %w", err)
+	}
+
+	if err := gc.sweepBlobs(ctx); err != nil {
+		return nil, fmt.Errorf("failed to sweep blobs: %w", err)
+	}
+
+	if err := gc.sweepStaging(ctx); err != nil {
+		return nil, fmt.Errorf("failed to sweep staging objects: %w", err)
+	}
+
+	gc.report.Live = len(gc.live)
+
+	slog.Info("finished garbage collection", "dryRun", opts.DryRun, "live", gc.report.Live,
+		"deleted", len(gc.report.Deleted), "freed", gc.report.Freed, "backend", s.Storage.Name())
+
+	return &gc.report, nil
+}
+
+func (gc *gcRun) expired(o storage.ObjectInfo, age time.Duration) bool {
+	return gc.now.Sub(o.Modified) > age
+}
+
+func (gc *gcRun) delete(ctx context.Context, o storage.ObjectInfo) error {
+	gc.report.Deleted = append(gc.report.Deleted, o)
+	gc.report.Freed += o.Size
+
+	if gc.opts.DryRun {
+		slog.Info("garbage collection would delete object", "path", o.Path, "size", o.Size)
+		return nil
+	}
+
+	// Objects are deleted from all tiers of the storage backend.
+	// Objects that are already gone have been collected by
+	// another instance.
+	slog.Debug("garbage collecting object", "path", o.Path, "size", o.Size)
+	if err := gc.s.Storage.Delete(ctx, o.Path); err != nil && !storage.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (gc *gcRun) fetch(ctx context.Context, path string) ([]byte, error) {
+	r, err := gc.remote.Fetch(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+func (gc *gcRun) markManifests(ctx context.Context) error {
+	manifests, err := gc.remote.List(ctx, "manifests/")
+	if err != nil {
+		return err
+	}
+
+	for _, o := range manifests {
+		key := strings.TrimPrefix(o.Path, "manifests/")
+
+		m, err := gc.fetch(ctx, o.Path)
+		if storage.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		// Expired manifests still mark the blobs they reference,
+		// which are kept alive by their tombstone afterwards.
+		if err := gc.markManifest(m); err != nil {
+			// Manifests that can not be parsed do not mark
+			// anything.
+			slog.Warn("failed to parse cached manifest during garbage collection", "err", err, "manifest", key)
+		}
+
+		if gc.opts.ManifestTTL > 0 && gc.expired(o, gc.opts.ManifestTTL) {
+			if err := gc.expire(ctx, o, key, m); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// expire deletes a cached manifest and leaves a tombstone in its place.
+//
+// Other instances might serve the manifest from their local caches
+// until they next validate it against the storage backend, which they
+// do at least twice per grace period. The tombstone keeps the blobs
+// referenced by the manifest for the grace period.
+func (gc *gcRun) expire(ctx context.Context, o storage.ObjectInfo, key string, m []byte) error {
+	if !gc.opts.DryRun {
+		_, _, err := gc.remote.Persist(ctx, "expired/"+key, "", func(w io.Writer) (string, int64, error) {
+			n, err := w.Write(m)
+			return "", int64(n), err
+		})
+
+		if err != nil {
+			return fmt.Errorf("failed to persist tombstone of manifest %s: %w", key, err)
+		}
+	}
+
+	if err := gc.delete(ctx, o); err != nil {
+		return err
+	}
+
+	if !gc.opts.DryRun {
+		gc.s.Cache.forgetManifest(key)
+	}
+
+	return nil
+}
+
+// markTombstones marks the blobs referenced by recently expired
+// manifests, and deletes tombstones older than the grace period.
+func (gc *gcRun) markTombstones(ctx context.Context) error {
+	tombstones, err := gc.remote.List(ctx, "expired/")
+	if err != nil {
+		return err
+	}
+
+	for _, o := range tombstones {
+		if gc.expired(o, gc.opts.Grace) {
+			if err := gc.delete(ctx, o); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		m, err := gc.fetch(ctx, o.Path)
+		if storage.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if err := gc.markManifest(m); err != nil {
+			slog.Warn("failed to parse manifest tombstone during garbage collection", "err", err, "path", o.Path)
+		}
+	}
+
+	return nil
+}
+
+// markManifest marks a manifest and all blobs it references.
+func (gc *gcRun) markManifest(m []byte) error {
+	var parsed struct {
+		Config manifest.Entry   `json:"config"`
+		Layers []manifest.Entry `json:"layers"`
+	}
+
+	if err := json.Unmarshal(m, &parsed); err != nil {
+		return err
+	}
+
+	// Manifests are also served by digest from the blob storage.
+	gc.mark(fmt.Sprintf("sha256:%x", sha256.Sum256(m)))
+	gc.mark(parsed.Config.Digest)
+	for _, l := range parsed.Layers {
+		gc.mark(l.Digest)
+	}
+
+	return nil
+}
+
+// markBlobManifests marks the blobs referenced by manifests of
+// uncacheable images. These manifests are only stored as blobs, and
+// are roots while they are younger than the grace period, as clients
+// might still pull the layers they reference.
+func (gc *gcRun) markBlobManifests(ctx context.Context) error {
+	blobs, err := gc.remote.List(ctx, "layers/")
+	if err != nil {
+		return err
+	}
+
+	for _, o := range blobs {
+		if gc.expired(o, gc.opts.Grace) || o.Size > manifest.MaxSize {
+			continue
+		}
+
+		info, err := gc.remote.Stat(ctx, o.Path)
+		if storage.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		// Blobs without a known content type are inspected, as
+		// long as they look like JSON.
+		switch info.ContentType {
+		case manifest.ManifestType, manifest.OCIManifestType, "":
+		default:
+			continue
+		}
+
+		m, err := gc.fetch(ctx, o.Path)
+		if storage.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if len(m) == 0 || m[0] != '{' {
+			continue
+		}
+
+		if err := gc.markManifest(m); err != nil {
+			slog.Debug("skipping unparseable blob during garbage collection", "err", err, "path", o.Path)
+		}
+	}
+
+	return nil
+}
+
+func (gc *gcRun) mark(digest string) {
+	gc.live[strings.TrimPrefix(digest, "sha256:")] = true
+}
+
+func (gc *gcRun) sweepBuilds(ctx context.Context) error {
+	builds, err := gc.remote.List(ctx, "builds/")
+	if err != nil {
+		return err
+	}
+
+	for _, o := range builds {
+		key := strings.TrimPrefix(o.Path, "builds/")
+
+		b, err := gc.fetch(ctx, o.Path)
+		if storage.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		var entry manifest.Entry
+		if err := json.Unmarshal(b, &entry); err != nil {
+			slog.Warn("failed to parse layer build during garbage collection", "err", err, "layer", key)
+			continue
+		}
+
+		digest := strings.TrimPrefix(entry.Digest, "sha256:")
+		if !gc.expired(o, gc.opts.Grace) || gc.live[digest] {
+			gc.live[digest] = true
+			continue
+		}
+
+		// The local cache entry is removed before the build,
+		// so that it never points to a deleted build.
+		if !gc.opts.DryRun {
+			gc.s.Cache.forgetLayer(key)
+		}
+
+		if err := gc.delete(ctx, o); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (gc *gcRun) sweepBlobs(ctx context.Context) error {
+	blobs, err := gc.remote.List(ctx, "layers/")
+	if err != nil {
+		return err
+	}
+
+	for _, o := range blobs {
+		if gc.live[strings.TrimPrefix(o.Path, "layers/")] || !gc.expired(o, gc.opts.Grace) {
+			continue
+		}
+
+		if err := gc.delete(ctx, o); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Staging objects are left behind by failed uploads, as successful
+// uploads are moved out of the staging area.
+func (gc *gcRun) sweepStaging(ctx context.Context) error {
+	staging, err := gc.remote.List(ctx, "staging/")
+	if err != nil {
+		return err
+	}
+
+	for _, o := range staging {
+		if !gc.expired(o, gc.opts.Grace) {
+			continue
+		}
+
+		if err := gc.delete(ctx, o); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,279 @@
+// Copyright The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nixery/config"
+	"github.com/google/nixery/manifest"
+	"github.com/google/nixery/storage"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("STORAGE_PATH", dir)
+
+	backend, err := storage.NewFSBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := NewCache(t.TempDir(), backend.Name(), 1<<20, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.db.Close()
+
+	old := time.Now().Add(-48 * time.Hour)
+	write := func(path, content string, mtime time.Time) {
+		full := filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(full, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := `{"config":{"digest":"sha256:config"},"layers":[{"digest":"sha256:referenced"}]}`
+	write("manifests/key", m, old)
+	write(fmt.Sprintf("layers/%x", sha256.Sum256([]byte(m))), m, old)
+
+	// Manifests of uncacheable images are only stored as blobs.
+	um := `{"config":{"digest":"sha256:uncacheable-config"},"layers":[{"digest":"sha256:uncacheable"}]}`
+	write(fmt.Sprintf("layers/%x", sha256.Sum256([]byte(um))), um, time.Now())
+
+	write("builds/referenced", `{"digest":"sha256:referenced"}`, old)
+	write("builds/uncacheable", `{"digest":"sha256:uncacheable"}`, old)
+	write("builds/unreferenced", `{"digest":"sha256:unreferenced"}`, old)
+	write("builds/recent", `{"digest":"sha256:recent"}`, time.Now())
+
+	write("layers/config", "", old)
+	write("layers/referenced", "", old)
+	write("layers/uncacheable", "", old)
+	write("layers/uncacheable-config", "", old)
+	write("layers/unreferenced", "", old)
+	write("layers/recent", "", old)
+	write("layers/orphan", "", old)
+	write("layers/new-orphan", "", time.Now())
+
+	write("staging/failed", "", old)
+	write("staging/in-progress", "", time.Now())
+
+	cache.localCacheLayer("unreferenced", manifest.Entry{Digest: "sha256:unreferenced"})
+
+	s := &State{
+		Storage: backend,
+		Cache:   cache,
+	}
+
+	for _, dryRun := range []bool{true, false} {
+		report, err := CollectGarbage(context.Background(), s, GCOptions{
+			Grace:  24 * time.Hour,
+			DryRun: dryRun,
+		})
+		if err != nil {
+			t.Fatalf("garbage collection failed: %s", err)
+		}
+
+		var deleted []string
+		for _, o := range report.Deleted {
+			deleted = append(deleted, o.Path)
+		}
+		sort.Strings(deleted)
+
+		expected := []string{
+			"builds/unreferenced",
+			"layers/orphan",
+			"layers/unreferenced",
+			"staging/failed",
+		}
+
+		if diff := cmp.Diff(expected, deleted); diff != "" {
+			t.Fatalf("unexpected objects deleted (dry run: %v):\n%s", dryRun, diff)
+		}
+
+		_, err = os.Stat(filepath.Join(dir, "layers/orphan"))
+		if dryRun != (err == nil) {
+			t.Fatalf("unexpected state of deleted object after GC (dry run: %v): %v", dryRun, err)
+		}
+	}
+
+	if _, ok := cache.layerFromLocalCache("unreferenced"); ok {
+		t.Error("collected layer build is still present in local cache")
+	}
+}
+
+func TestLayerUseRecorded(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("STORAGE_PATH", dir)
+
+	backend, err := storage.NewFSBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := NewCache(t.TempDir(), backend.Name(), 1<<20, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.db.Close()
+
+	s := &State{
+		Storage: backend,
+		Cache:   cache,
+		Cfg:     config.Config{GCGrace: 24 * time.Hour},
+	}
+
+	ctx := context.Background()
+	old := time.Now().Add(-48 * time.Hour)
+	for _, l := range []string{"used", "collected"} {
+		cacheLayer(ctx, s, l, manifest.Entry{Digest: "sha256:" + l})
+		if err := os.Chtimes(filepath.Join(dir, "builds", l), old, old); err != nil {
+			t.Fatal(err)
+		}
+
+		// The use of locally cached builds is recorded again
+		// once half of the grace period has passed.
+		cache.lused[l] = old
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "layers"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "layers", "used"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := layerFromCache(ctx, s, "used"); !ok {
+		t.Fatal("used layer build was not found")
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "builds", "used"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(info.ModTime()) > time.Hour {
+		t.Errorf("use of layer build was not recorded, last modified at %s", info.ModTime())
+	}
+
+	// The blob of this build has been collected by another instance,
+	// which invalidates the local cache entry.
+	if _, ok := layerFromCache(ctx, s, "collected"); ok {
+		t.Error("layer build with collected blob was returned")
+	}
+
+	if _, ok := cache.layerFromLocalCache("collected"); ok {
+		t.Error("layer build with collected blob is still present in local cache")
+	}
+}
+
+func TestManifestExpiry(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("STORAGE_PATH", dir)
+
+	backend, err := storage.NewFSBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two instances share the storage backend, and the second one
+	// has the manifest in its local cache.
+	var caches []*LocalCache
+	for range 2 {
+		cache, err := NewCache(t.TempDir(), backend.Name(), 1<<20, 1<<20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cache.db.Close()
+
+		caches = append(caches, cache)
+	}
+
+	old := time.Now().Add(-48 * time.Hour)
+	write := func(path, content string) {
+		full := filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(full, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := `{"layers":[{"digest":"sha256:layer"}]}`
+	write("manifests/key", m)
+	write("builds/layer", `{"digest":"sha256:layer"}`)
+	write("layers/layer", "")
+
+	caches[1].localCacheManifest("key", json.RawMessage(m))
+
+	ctx := context.Background()
+	gc := &State{Storage: backend, Cache: caches[0]}
+	replica := &State{
+		Storage: backend,
+		Cache:   caches[1],
+		Cfg:     config.Config{GCGrace: 24 * time.Hour},
+	}
+
+	collect := func() []string {
+		report, err := CollectGarbage(ctx, gc, GCOptions{
+			Grace:       24 * time.Hour,
+			ManifestTTL: 24 * time.Hour,
+		})
+		if err != nil {
+			t.Fatalf("garbage collection failed: %s", err)
+		}
+
+		var deleted []string
+		for _, o := range report.Deleted {
+			deleted = append(deleted, o.Path)
+		}
+		sort.Strings(deleted)
+
+		return deleted
+	}
+
+	// The expired manifest is replaced by a tombstone, which keeps
+	// the blobs it references.
+	if diff := cmp.Diff([]string{"manifests/key"}, collect()); diff != "" {
+		t.Fatalf("unexpected objects deleted while expiring manifest:\n%s", diff)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "layers/layer")); err != nil {
+		t.Errorf("blob of expired manifest was deleted too early: %s", err)
+	}
+
+	// The other instance notices the expiry once it validates its
+	// local copy.
+	caches[1].checked["key"] = old
+	if _, ok := manifestFromCache(ctx, replica, "key"); ok {
+		t.Error("expired manifest was served from the local cache")
+	}
+
+	// Blobs are released once the tombstone is older than the grace
+	// period.
+	if err := os.Chtimes(filepath.Join(dir, "expired/key"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]string{"builds/layer", "expired/key", "layers/layer"}, collect()); diff != "" {
+		t.Errorf("unexpected objects deleted after tombstone expired:\n%s", diff)
+	}
+}
@@ -15,6 +15,7 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
@@ -23,7 +24,10 @@ import (
 	"net/http"
 	"os"
 	"regexp"
+	"sort"
+	"strings"
 	"text/template"
+	"time"
 
 	"github.com/google/nixery/assets"
 	"github.com/google/nixery/builder"
@@ -34,12 +38,6 @@ import (
 	"github.com/im7mortal/kmutex"
 )
 
-// ManifestMediaType is the Content-Type used for the manifest itself. This
-// corresponds to the "Image Manifest V2, Schema 2" described on this page:
-//
-// https://docs.docker.com/registry/spec/manifest-v2-2/
-const manifestMediaType string = "application/vnd.docker.distribution.manifest.v2+json"
-
 // This variable will be initialised during the build process and set
 // to the hash of the entire Nixery source tree.
 var version string = "devel"
@@ -48,6 +46,18 @@ var version string = "devel"
 type indexHandler struct {
 	template *template.Template
 	errors   *builder.ErrorCache
+	sources  []string
+}
+
+// sourceNames returns the sorted names of the named package sources.
+func sourceNames(cfg config.Config) []string {
+	var names []string
+	for name := range cfg.Sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
 }
 
 func (h *indexHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -60,10 +70,12 @@ func (h *indexHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		Hostname string
 		Version  string
 		Errors   []*builder.BuildError
+		Sources  []string
 	}{
 		Hostname: hostname,
 		Version:  version,
 		Errors:   h.errors.GetAllErrors(),
+		Sources:  h.sources,
 	}
 
 	err := h.template.Execute(w, data)
@@ -136,12 +148,60 @@ type registryHandler struct {
 	state *builder.State
 }
 
+// acceptsManifest checks whether the client has indicated support for
+// the given manifest media type in its Accept headers.
+func acceptsManifest(r *http.Request, mediaType string) bool {
+	for _, header := range r.Header.Values("Accept") {
+		for _, accepted := range strings.Split(header, ",") {
+			t, _, _ := strings.Cut(strings.TrimSpace(accepted), ";")
+			if t == mediaType {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// layerCompression selects the compression to use for an image based
+// on the configuration and the manifest types accepted by the client.
+//
+// zstd-compressed and eStargz layers are only served in OCI manifests,
+// all other clients receive gzip-compressed layers.
+func (h *registryHandler) layerCompression(r *http.Request) mf.Compression {
+	if !acceptsManifest(r, mf.OCIManifestType) {
+		return mf.Gzip
+	}
+
+	switch {
+	case h.state.Cfg.Zstd:
+		return mf.Zstd
+	case h.state.Cfg.Estargz:
+		return mf.Estargz
+	default:
+		return mf.Gzip
+	}
+}
+
 // Serve a manifest by tag, building it via Nix and populating caches
 // if necessary.
 func (h *registryHandler) serveManifestTag(w http.ResponseWriter, r *http.Request, name string, tag string) {
-	slog.Info("requesting image manifest", "image", name, "tag", tag)
+	compression := h.layerCompression(r)
+	slog.Info("requesting image manifest", "image", name, "tag", tag, "compression", compression.String())
+
+	// The first component of the name may select a named package
+	// source, all other images are built from the default source.
+	source, pkgs := h.state.Cfg.SplitSource(name)
+	if h.state.Cfg.PkgSource(source) == nil {
+		s := fmt.Sprintf("Unknown package source, image names must start with one of: %s", strings.Join(sourceNames(h.state.Cfg), ", "))
+		writeError(w, 404, "NAME_UNKNOWN", s)
 
-	image := builder.ImageFromName(name, tag)
+		return
+	}
+
+	image := builder.ImageFromName(pkgs, tag)
+	image.Source = source
+	image.Compression = compression
 	buildResult, err := builder.BuildImage(r.Context(), h.state, &image)
 
 	if err != nil {
@@ -163,10 +223,17 @@ func (h *registryHandler) serveManifestTag(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	if buildResult.Error == "unknown_tag" {
+		s := fmt.Sprintf("Tag %q does not select a version of the package set", tag)
+		writeError(w, 404, "MANIFEST_UNKNOWN", s)
+
+		return
+	}
+
 	// This marshaling error is ignored because we know that this
 	// field represents valid JSON data.
 	manifest, _ := json.Marshal(buildResult.Manifest)
-	w.Header().Add("Content-Type", manifestMediaType)
+	w.Header().Add("Content-Type", image.Compression.ManifestType())
 
 	// The manifest needs to be persisted to the blob storage (to become
 	// available for clients that fetch manifests by their hash, e.g.
@@ -181,7 +248,7 @@ func (h *registryHandler) serveManifestTag(w http.ResponseWriter, r *http.Reques
 	path := "layers/" + sha256sum
 	ctx := r.Context()
 
-	_, _, err = h.state.Storage.Persist(ctx, path, mf.ManifestType, func(sw io.Writer) (string, int64, error) {
+	_, _, err = h.state.Storage.Persist(ctx, path, image.Compression.ManifestType(), func(sw io.Writer) (string, int64, error) {
 		// We already know the hash, so no additional hash needs to be
 		// constructed here.
 		written, err := sw.Write(manifest)
@@ -199,6 +266,53 @@ func (h *registryHandler) serveManifestTag(w http.ResponseWriter, r *http.Reques
 	w.Write(manifest)
 }
 
+// Serve a manifest by digest. Manifests are stored as blobs, but are
+// always served by Nixery itself: Clients expect the manifest media
+// type, which is not known to storage services that they might be
+// redirected to, and might not be allowed to pull from them.
+func (h *registryHandler) serveManifestDigest(w http.ResponseWriter, r *http.Request, digest string) {
+	body, err := h.state.Storage.Fetch(r.Context(), "layers/"+digest)
+	if err != nil {
+		writeError(w, 404, "MANIFEST_UNKNOWN", "Manifest is not known")
+
+		slog.Warn("failed to fetch manifest by digest", "err", err, "digest", digest, "backend", h.state.Storage.Name())
+
+		return
+	}
+	defer body.Close()
+
+	manifest, err := io.ReadAll(io.LimitReader(body, mf.MaxSize+1))
+	if err != nil {
+		writeError(w, 500, "UNKNOWN", "could not read manifest from blob store")
+
+		slog.Error("failed to read manifest by digest", "err", err, "digest", digest, "backend", h.state.Storage.Name())
+
+		return
+	}
+
+	// Manifests name their own media type, which also rules out
+	// serving other blobs as manifests.
+	var parsed struct {
+		MediaType string `json:"mediaType"`
+	}
+
+	sha256sum := fmt.Sprintf("%x", sha256.Sum256(manifest))
+	if sha256sum != digest || json.Unmarshal(manifest, &parsed) != nil ||
+		(parsed.MediaType != mf.ManifestType && parsed.MediaType != mf.OCIManifestType) {
+		writeError(w, 404, "MANIFEST_UNKNOWN", "Manifest is not known")
+
+		return
+	}
+
+	w.Header().Set("Content-Type", parsed.MediaType)
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(manifest)))
+	w.Header().Set("Docker-Content-Digest", "sha256:"+digest)
+
+	if r.Method != http.MethodHead {
+		w.Write(manifest)
+	}
+}
+
 // serveBlob serves a blob from storage by digest
 func (h *registryHandler) serveBlob(w http.ResponseWriter, r *http.Request, blobType, digest string) {
 	storage := h.state.Storage
@@ -224,6 +338,11 @@ func (h *registryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// Serve a blob by digest
 	layerMatches := blobRegex.FindStringSubmatch(r.RequestURI)
+	if len(layerMatches) == 4 && layerMatches[2] == "manifests" {
+		h.serveManifestDigest(w, r, layerMatches[3])
+		return
+	}
+
 	if len(layerMatches) == 4 {
 		h.serveBlob(w, r, layerMatches[2], layerMatches[3])
 		return
@@ -234,6 +353,23 @@ func (h *registryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(404)
 }
 
+// collectGarbage periodically removes unreferenced objects from the
+// storage backend.
+func collectGarbage(state *builder.State) {
+	opts := builder.GCOptions{
+		Grace:       state.Cfg.GCGrace,
+		ManifestTTL: state.Cfg.GCManifestTTL,
+		DryRun:      state.Cfg.GCDryRun,
+	}
+
+	for range time.Tick(state.Cfg.GCInterval) {
+		_, err := builder.CollectGarbage(context.Background(), state, opts)
+		if err != nil {
+			slog.Error("garbage collection failed", "err", err, "backend", state.Storage.Name())
+		}
+	}
+}
+
 func main() {
 	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
 		AddSource: true,
@@ -256,15 +392,40 @@ func main() {
 		s, err = storage.NewGCSBackend()
 	case config.FileSystem:
 		s, err = storage.NewFSBackend()
+	case config.S3:
+		s, err = storage.NewS3Backend()
+	case config.Registry:
+		s, err = storage.NewRegistryBackend()
 	}
 	if err != nil {
 		slog.Error("failed to initialise storage backend", "err", err)
 		os.Exit(1)
 	}
 
-	slog.Info("initialised storage backend", "backend", s.Name())
+	// A local tier is pointless for the filesystem backend, which
+	// is local already.
+	if cfg.Backend != config.FileSystem && cfg.StorageCachePath != "" {
+		s, err = storage.NewTieredBackend(s, cfg.StorageCachePath, cfg.StorageCacheLimit, cfg.StorageCacheServe)
+		if err != nil {
+			slog.Error("failed to initialise local storage tier", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	// The filesystem backend serves blobs itself, all others
+	// redirect clients unless blobs are proxied.
+	if cfg.Backend != config.FileSystem && (cfg.Proxy || len(cfg.ProxyNetworks) > 0) {
+		s = storage.NewProxyBackend(s, storage.ProxyOptions{
+			Always:         cfg.Proxy,
+			Networks:       cfg.ProxyNetworks,
+			TrustedProxies: cfg.ProxyTrusted,
+			Verify:         cfg.ProxyVerify,
+		})
+	}
+
+	slog.Info("initialised storage backend", "backend", s.Name(), "proxy", cfg.Proxy, "proxyNetworks", len(cfg.ProxyNetworks))
 
-	cache, err := builder.NewCache()
+	cache, err := builder.NewCache(cfg.CachePath, s.Name(), cfg.ManifestCacheMemory, cfg.ManifestCacheDisk)
 	if err != nil {
 		slog.Error("failed to instantiate build cache", "err", err)
 		os.Exit(1)
@@ -280,7 +441,7 @@ func main() {
 	}
 
 	state := builder.State{
-		Cache:       &cache,
+		Cache:       cache,
 		Cfg:         cfg,
 		Pop:         pop,
 		Storage:     s,
@@ -288,6 +449,10 @@ func main() {
 		Errors:      builder.NewErrorCache(15),
 	}
 
+	if cfg.GCInterval > 0 {
+		go collectGarbage(&state)
+	}
+
 	slog.Info("starting Nixery", "version", version, "port", cfg.Port)
 
 	// All /v2/ requests belong to the registry handler.
@@ -303,7 +468,13 @@ func main() {
 	}
 
 	// Serve the main index page with dynamic content
-	http.Handle("/", &indexHandler{tmpl, state.Errors})
+	http.Handle("/", &indexHandler{tmpl, state.Errors, sourceNames(cfg)})
+
+	// Expose statistics about the local manifest cache
+	http.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cache.Stats())
+	})
 
 	// Serve static assets (logo, etc.) from embedded filesystem
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(assets.Files))))
@@ -0,0 +1,160 @@
+// Copyright The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// channelPinner resolves moving nixpkgs channels (such as
+// "nixos-unstable") to the commit they currently point to, which makes
+// builds from channels cacheable.
+//
+// Commits are looked up either on a channel server that serves the
+// commit of each channel at `<channel>/git-revision` (as
+// channels.nixos.org does), or in a local JSON file mapping channel
+// names to commits.
+type channelPinner struct {
+	resolver string // base URL of the channel server
+	pinFile  string // path to the mapping file, replaces the server if set
+	refresh  time.Duration
+	client   *http.Client
+
+	mu     sync.Mutex // only guards the map, channels are locked individually
+	pinned map[string]*pinnedChannel
+}
+
+type pinnedChannel struct {
+	mu       sync.Mutex // held while the channel is looked up
+	commit   string     // empty until the channel has been pinned
+	pinnedAt time.Time
+	err      error // error of the last lookup of an unpinned channel
+	failedAt time.Time
+}
+
+// Channels that could not be pinned are looked up again after this
+// time, so that an unavailable resolver is not queried on every request.
+const pinRetryInterval = 30 * time.Second
+
+func newChannelPinner(resolver, pinFile string, refresh time.Duration) *channelPinner {
+	return &channelPinner{
+		resolver: strings.TrimSuffix(resolver, "/"),
+		pinFile:  pinFile,
+		refresh:  refresh,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		pinned:   make(map[string]*pinnedChannel),
+	}
+}
+
+// lookup retrieves the current commit of a channel.
+func (p *channelPinner) lookup(channel string) (string, error) {
+	if p.pinFile != "" {
+		f, err := os.ReadFile(p.pinFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read channel pins: %w", err)
+		}
+
+		var pins map[string]string
+		if err := json.Unmarshal(f, &pins); err != nil {
+			return "", fmt.Errorf("failed to parse channel pins in %s: %w", p.pinFile, err)
+		}
+
+		commit, ok := pins[channel]
+		if !ok {
+			return "", fmt.Errorf("channel %q is not pinned in %s", channel, p.pinFile)
+		}
+
+		return commit, nil
+	}
+
+	resp, err := p.client.Get(fmt.Sprintf("%s/%s/git-revision", p.resolver, channel))
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve commit for channel %q: %w", channel, err)
+	}
+	defer resp.Body.Close()
+
+	commit, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return "", fmt.Errorf("failed to read commit for channel %q: %w", channel, err)
+	}
+
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("non-success status code when fetching commit for channel %q: %s", channel, resp.Status)
+	}
+
+	return strings.TrimSpace(string(commit)), nil
+}
+
+// channel returns the pin of a channel, which is empty if the channel
+// has not been pinned yet.
+func (p *channelPinner) channel(channel string) *pinnedChannel {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c, ok := p.pinned[channel]
+	if !ok {
+		c = &pinnedChannel{}
+		p.pinned[channel] = c
+	}
+
+	return c
+}
+
+// pin returns the commit that a channel is pinned to. Pins are renewed
+// after the refresh interval, but an outdated pin is kept if renewing
+// it fails.
+//
+// Requests for the same channel wait for a single lookup, while other
+// channels are not blocked by it.
+func (p *channelPinner) pin(channel string) (string, error) {
+	c := p.channel(channel)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.commit != "" && time.Since(c.pinnedAt) < p.refresh {
+		return c.commit, nil
+	}
+
+	if c.commit == "" && c.err != nil && time.Since(c.failedAt) < pinRetryInterval {
+		return "", c.err
+	}
+
+	commit, err := p.lookup(channel)
+	if err == nil && !commitRegex.MatchString(commit) {
+		err = fmt.Errorf("channel %q resolved to invalid commit %q", channel, commit)
+	}
+
+	if err != nil {
+		if c.commit == "" {
+			c.err = err
+			c.failedAt = time.Now()
+			return "", err
+		}
+
+		// The outdated pin is renewed for another interval, so
+		// that an unavailable resolver is not queried on every
+		// request.
+		slog.Warn("failed to renew channel pin, keeping previous commit", "err", err, "channel", channel, "commit", c.commit)
+		c.pinnedAt = time.Now()
+		return c.commit, nil
+	}
+
+	if c.commit != commit {
+		slog.Info("pinned nixpkgs channel", "channel", channel, "commit", commit)
+	}
+
+	c.commit = commit
+	c.pinnedAt = time.Now()
+	c.err = nil
+
+	return commit, nil
+}
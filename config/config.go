@@ -7,8 +7,16 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"log/slog"
+	"net"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func getConfig(key, desc, def string) string {
@@ -23,46 +31,288 @@ func getConfig(key, desc, def string) string {
 	return value
 }
 
+// getNumber reads a positive number from the environment, returning
+// the default if it is not set.
+func getNumber(key string, def int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("%s must be a positive number, got %q", key, value)
+	}
+
+	return n, nil
+}
+
+// getDuration reads a duration (such as "24h") from the environment,
+// returning the default if it is not set.
+func getDuration(key string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%s must be a valid duration, got %q", key, value)
+	}
+
+	return d, nil
+}
+
+// getNetworks reads a comma-separated list of networks in CIDR
+// notation from the environment.
+func getNetworks(key string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, cidr := range strings.Split(os.Getenv(key), ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a list of networks in CIDR notation: %w", key, err)
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// getMapping reads a comma-separated list of key=value pairs from the
+// environment.
+func getMapping(key string) (map[string]string, error) {
+	mapping := make(map[string]string)
+
+	for _, pair := range strings.Split(os.Getenv(key), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		k, v, found := strings.Cut(pair, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !found || k == "" || v == "" {
+			return nil, fmt.Errorf("%s must be a list of key=value pairs, got %q", key, pair)
+		}
+
+		mapping[k] = v
+	}
+
+	return mapping, nil
+}
+
 // Backend represents the possible storage backend types
 type Backend int
 
 const (
 	GCS = iota
 	FileSystem
+	S3
+	Registry
 )
 
 // Config holds the Nixery configuration options.
 type Config struct {
-	Port    string    // Port on which to launch HTTP server
-	Pkgs    PkgSource // Source for Nix package set
-	Timeout string    // Timeout for a single Nix builder (seconds)
+	Port    string               // Port on which to launch HTTP server
+	Pkgs    PkgSource            // Default source for Nix package set (nil if only named sources are used)
+	Sources map[string]PkgSource // Named sources, selected by the first component of image names
+	Timeout string               // Timeout for a single Nix builder (seconds)
+
+	NixpkgsArgs map[string]*NixpkgsArgs // nixpkgs configuration of package sources, by source name
+	Credentials map[string]*Credentials // Credentials of package sources, by source name
 
 	PopUrl  string  // URL to the Nix package popularity count
 	Backend Backend // Storage backend to use for Nixery
+	Zstd    bool    // Offer zstd-compressed layers to supporting clients
+	Estargz bool    // Offer lazily pullable eStargz layers to supporting clients
+	Workers int     // Number of layers to build and upload concurrently
+
+	CachePath           string // Directory for the local cache index
+	ManifestCacheMemory int64  // Size limit of manifests cached in memory (bytes)
+	ManifestCacheDisk   int64  // Size limit of manifests cached on disk (bytes)
+
+	GCInterval    time.Duration // Interval between garbage collection runs (0 disables GC)
+	GCGrace       time.Duration // Minimum age of objects deleted by garbage collection
+	GCManifestTTL time.Duration // Maximum age of cached manifests (0 keeps them forever)
+	GCDryRun      bool          // Only report objects that garbage collection would delete
+
+	Proxy         bool         // Stream blobs through Nixery instead of redirecting clients
+	ProxyNetworks []*net.IPNet // Client networks for which blobs are always streamed
+	ProxyVerify   bool         // Verify the digests of streamed blobs
+	ProxyTrusted  []*net.IPNet // Reverse proxies whose X-Forwarded-For header is trusted
+
+	StorageCachePath  string // Directory of the local storage tier (empty disables it)
+	StorageCacheLimit int64  // Size limit of the local storage tier (bytes)
+	StorageCacheServe bool   // Serve blobs from the local storage tier
+}
+
+// SplitSource splits an image name into the name of its package source
+// and the remaining name. Images whose name does not start with a named
+// source use the default source, which is named "".
+func (c *Config) SplitSource(name string) (string, string) {
+	source, rest, found := strings.Cut(name, "/")
+	if _, ok := c.Sources[source]; ok && found && rest != "" {
+		return source, rest
+	}
+
+	return "", name
+}
+
+// PkgSource returns the package source with the given name, or nil if
+// there is no such source.
+func (c *Config) PkgSource(name string) PkgSource {
+	if name == "" {
+		return c.Pkgs
+	}
+
+	return c.Sources[name]
 }
 
 func FromEnv() (Config, error) {
-	pkgs, err := pkgSourceFromEnv()
+	named, err := namedPkgSourcesFromEnv()
 	if err != nil {
 		return Config{}, err
 	}
 
+	creds, err := credentialsFromEnv("NIXERY_")
+	if err != nil {
+		return Config{}, err
+	}
+
+	// The default package source is optional if named sources are
+	// configured.
+	pkgs, err := pkgSourceFromEnv("NIXERY_", creds)
+	if err != nil && !(errors.Is(err, errNoPkgSource) && len(named.sources) > 0) {
+		return Config{}, err
+	}
+
+	if pkgs != nil {
+		args, err := nixpkgsArgsFromEnv("NIXERY_", pkgs)
+		if err != nil {
+			return Config{}, err
+		}
+
+		if args != nil {
+			named.nixpkgsArgs[""] = args
+		}
+
+		if creds != nil {
+			slog.Info("using credentials for default package source", "credentials", creds)
+			named.credentials[""] = creds
+		}
+	}
+
+	// Backends that redirect clients can be configured to proxy
+	// blobs instead. The filesystem backend always serves them.
 	var b Backend
+	var proxy bool
 	switch os.Getenv("NIXERY_STORAGE_BACKEND") {
 	case "gcs":
 		b = GCS
+		proxy = os.Getenv("GCS_PROXY") == "true"
 	case "filesystem":
 		b = FileSystem
+	case "s3":
+		b = S3
+		proxy = os.Getenv("S3_PROXY") == "true"
+	case "registry":
+		b = Registry
+		// Redirected clients would need to be allowed to
+		// pull anonymously from the upstream registry.
+		proxy = os.Getenv("REGISTRY_PROXY") != "false"
 	default:
-		slog.Error("NIXERY_STORAGE_BACKEND must be set to a supported value (gcs or filesystem)")
+		slog.Error("NIXERY_STORAGE_BACKEND must be set to a supported value (gcs, s3, registry or filesystem)")
 		os.Exit(1)
 	}
 
+	zstd := os.Getenv("NIXERY_ENABLE_ZSTD") == "true"
+	estargz := os.Getenv("NIXERY_ENABLE_ESTARGZ") == "true"
+	if zstd && estargz {
+		return Config{}, fmt.Errorf("NIXERY_ENABLE_ZSTD and NIXERY_ENABLE_ESTARGZ are mutually exclusive")
+	}
+
+	workers, err := getNumber("NIXERY_BUILD_WORKERS", runtime.NumCPU())
+	if err != nil {
+		return Config{}, err
+	}
+
+	memoryMB, err := getNumber("NIXERY_MANIFEST_CACHE_MEMORY_MB", 64)
+	if err != nil {
+		return Config{}, err
+	}
+
+	diskMB, err := getNumber("NIXERY_MANIFEST_CACHE_DISK_MB", 1024)
+	if err != nil {
+		return Config{}, err
+	}
+
+	gcInterval, err := getDuration("NIXERY_GC_INTERVAL", 0)
+	if err != nil {
+		return Config{}, err
+	}
+
+	gcGrace, err := getDuration("NIXERY_GC_GRACE", 7*24*time.Hour)
+	if err != nil {
+		return Config{}, err
+	}
+
+	gcManifestTTL, err := getDuration("NIXERY_GC_MANIFEST_TTL", 0)
+	if err != nil {
+		return Config{}, err
+	}
+
+	proxyNetworks, err := getNetworks("NIXERY_PROXY_NETWORKS")
+	if err != nil {
+		return Config{}, err
+	}
+
+	proxyTrusted, err := getNetworks("NIXERY_TRUSTED_PROXIES")
+	if err != nil {
+		return Config{}, err
+	}
+
+	storageCacheMB, err := getNumber("NIXERY_STORAGE_CACHE_MB", 10240)
+	if err != nil {
+		return Config{}, err
+	}
+
 	return Config{
 		Port:    getConfig("PORT", "HTTP port", ""),
 		Pkgs:    pkgs,
-		Timeout: getConfig("NIX_TIMEOUT", "Nix builder timeout", "60"),
-		PopUrl:  os.Getenv("NIX_POPULARITY_URL"),
-		Backend: b,
+		Sources: named.sources,
+
+		NixpkgsArgs: named.nixpkgsArgs,
+		Credentials: named.credentials,
+		Timeout:     getConfig("NIX_TIMEOUT", "Nix builder timeout", "60"),
+		PopUrl:      os.Getenv("NIX_POPULARITY_URL"),
+		Backend:     b,
+		Zstd:        zstd,
+		Estargz:     estargz,
+		Workers:     workers,
+
+		CachePath:           getConfig("NIXERY_CACHE_PATH", "local cache directory", filepath.Join(os.TempDir(), "nixery")),
+		ManifestCacheMemory: int64(memoryMB) << 20,
+		ManifestCacheDisk:   int64(diskMB) << 20,
+
+		GCInterval:    gcInterval,
+		GCGrace:       gcGrace,
+		GCManifestTTL: gcManifestTTL,
+		GCDryRun:      os.Getenv("NIXERY_GC_DRY_RUN") == "true",
+
+		Proxy:         proxy,
+		ProxyNetworks: proxyNetworks,
+		ProxyVerify:   os.Getenv("NIXERY_PROXY_VERIFY") == "true",
+		ProxyTrusted:  proxyTrusted,
+
+		StorageCachePath:  os.Getenv("NIXERY_STORAGE_CACHE_PATH"),
+		StorageCacheLimit: int64(storageCacheMB) << 20,
+		StorageCacheServe: os.Getenv("NIXERY_STORAGE_CACHE_SERVE") == "true",
 	}, nil
 }
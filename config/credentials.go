@@ -0,0 +1,165 @@
+// Copyright The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Credentials configures access to a private package source and to the
+// binary caches it is built with.
+//
+// Credentials are only passed to the git and Nix processes working on
+// the package source, through their environment. They are never part
+// of command lines or logs.
+type Credentials struct {
+	SSHKey        string // Path to an SSH private key used by git
+	SSHKnownHosts string // Path to a known hosts file used by git
+	Netrc         string // Path to a netrc file used by Nix for downloads
+	AccessTokens  string // Access tokens for Nix fetchers, as in nix.conf
+
+	Substituters      []string // Additional binary caches
+	TrustedPublicKeys []string // Keys that binary caches are signed with
+}
+
+// LogValue describes which credentials are set, without revealing them.
+func (c *Credentials) LogValue() slog.Value {
+	if c == nil {
+		return slog.StringValue("none")
+	}
+
+	return slog.GroupValue(
+		slog.Bool("sshKey", c.SSHKey != ""),
+		slog.Bool("netrc", c.Netrc != ""),
+		slog.Bool("accessTokens", c.AccessTokens != ""),
+		slog.Any("substituters", c.Substituters),
+	)
+}
+
+// shellQuote quotes a string for use in a shell command.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Env returns the environment of processes using the credentials,
+// which is the environment of Nixery with the credentials added.
+//
+// git and SSH never prompt for credentials in this environment, as
+// there is nobody to answer and the prompt would block the process.
+func (c *Credentials) Env() []string {
+	env := append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+
+	// An SSH command configured for Nixery is kept if no key is
+	// set for the package source.
+	if c != nil && c.SSHKey != "" {
+		ssh := "ssh -o BatchMode=yes -o IdentitiesOnly=yes -i " + shellQuote(c.SSHKey)
+		if c.SSHKnownHosts != "" {
+			ssh += " -o UserKnownHostsFile=" + shellQuote(c.SSHKnownHosts)
+		}
+
+		env = append(env, "GIT_SSH_COMMAND="+ssh)
+	} else if os.Getenv("GIT_SSH_COMMAND") == "" && os.Getenv("GIT_SSH") == "" {
+		env = append(env, "GIT_SSH_COMMAND=ssh -o BatchMode=yes")
+	}
+
+	if c == nil {
+		return env
+	}
+
+	// Settings in NIX_CONFIG take precedence over nix.conf, and
+	// are appended to those already set for Nixery.
+	var settings []string
+	if existing := os.Getenv("NIX_CONFIG"); existing != "" {
+		settings = append(settings, existing)
+	}
+
+	if c.Netrc != "" {
+		settings = append(settings, "netrc-file = "+c.Netrc)
+	}
+
+	if c.AccessTokens != "" {
+		settings = append(settings, "access-tokens = "+c.AccessTokens)
+	}
+
+	if len(c.Substituters) > 0 {
+		settings = append(settings, "extra-substituters = "+strings.Join(c.Substituters, " "))
+	}
+
+	if len(c.TrustedPublicKeys) > 0 {
+		settings = append(settings, "extra-trusted-public-keys = "+strings.Join(c.TrustedPublicKeys, " "))
+	}
+
+	if len(settings) > 0 {
+		env = append(env, "NIX_CONFIG="+strings.Join(settings, "\n"))
+	}
+
+	return env
+}
+
+// Retrieve the credentials of a package source from the environment
+// variables starting with the given prefix. Nil is returned if no
+// credentials are set.
+func credentialsFromEnv(prefix string) (*Credentials, error) {
+	var c Credentials
+	var err error
+
+	file := func(key string) string {
+		path := os.Getenv(prefix + key)
+		if path == "" || err != nil {
+			return ""
+		}
+
+		if path, err = filepath.Abs(path); err == nil {
+			_, err = os.Stat(path)
+		}
+
+		if err != nil {
+			err = fmt.Errorf("invalid file in %s%s: %w", prefix, key, err)
+		}
+
+		return path
+	}
+
+	list := func(key string) []string {
+		return strings.FieldsFunc(os.Getenv(prefix+key), func(r rune) bool {
+			return r == ',' || r == ' '
+		})
+	}
+
+	c.SSHKey = file("SSH_KEY")
+	c.SSHKnownHosts = file("SSH_KNOWN_HOSTS")
+	c.Netrc = file("NETRC")
+	c.AccessTokens = strings.TrimSpace(os.Getenv(prefix + "ACCESS_TOKENS"))
+	c.Substituters = list("SUBSTITUTERS")
+	c.TrustedPublicKeys = list("TRUSTED_PUBLIC_KEYS")
+
+	if err != nil {
+		return nil, err
+	}
+
+	// All values are written into NIX_CONFIG, where newlines would
+	// allow adding arbitrary Nix settings.
+	values := map[string][]string{
+		"NETRC":               {c.Netrc},
+		"ACCESS_TOKENS":       {c.AccessTokens},
+		"SUBSTITUTERS":        c.Substituters,
+		"TRUSTED_PUBLIC_KEYS": c.TrustedPublicKeys,
+	}
+
+	for key, v := range values {
+		if strings.ContainsAny(strings.Join(v, ""), "\r\n") {
+			return nil, fmt.Errorf("%s%s must not contain newlines", prefix, key)
+		}
+	}
+
+	if c.SSHKey == "" && c.SSHKnownHosts == "" && c.Netrc == "" && c.AccessTokens == "" &&
+		len(c.Substituters) == 0 && len(c.TrustedPublicKeys) == 0 {
+		return nil, nil
+	}
+
+	return &c, nil
+}
@@ -0,0 +1,89 @@
+// Copyright The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package config
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCredentials(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "it's secret")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	key, netrc := filepath.Join(dir, "id_ed25519"), filepath.Join(dir, "netrc")
+	for _, f := range []string{key, netrc} {
+		if err := os.WriteFile(f, []byte("secret"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Setenv("NIX_CONFIG", "sandbox = true")
+	t.Setenv("NIXERY_SSH_KEY", key)
+	t.Setenv("NIXERY_NETRC", netrc)
+	t.Setenv("NIXERY_ACCESS_TOKENS", "github.com=ghp_secret")
+	t.Setenv("NIXERY_SUBSTITUTERS", "https://cache.example.com, s3://nix-cache")
+	t.Setenv("NIXERY_TRUSTED_PUBLIC_KEYS", "cache.example.com-1:abc=")
+
+	creds, err := credentialsFromEnv("NIXERY_")
+	if err != nil {
+		t.Fatalf("failed to configure credentials: %s", err)
+	}
+
+	env := make(map[string]string)
+	for _, e := range creds.Env() {
+		k, v, _ := strings.Cut(e, "=")
+		env[k] = v
+	}
+
+	expectedSSH := `ssh -o BatchMode=yes -o IdentitiesOnly=yes -i '` + strings.ReplaceAll(key, "'", `'\''`) + `'`
+	if env["GIT_SSH_COMMAND"] != expectedSSH {
+		t.Errorf("unexpected SSH command: %s", env["GIT_SSH_COMMAND"])
+	}
+
+	if env["GIT_TERMINAL_PROMPT"] != "0" {
+		t.Error("git may prompt for credentials")
+	}
+
+	expectedConfig := []string{
+		"sandbox = true",
+		"netrc-file = " + netrc,
+		"access-tokens = github.com=ghp_secret",
+		"extra-substituters = https://cache.example.com s3://nix-cache",
+		"extra-trusted-public-keys = cache.example.com-1:abc=",
+	}
+	if diff := cmp.Diff(expectedConfig, strings.Split(env["NIX_CONFIG"], "\n")); diff != "" {
+		t.Errorf("unexpected Nix configuration:\n%s", diff)
+	}
+
+	// Credentials are never logged.
+	var buf bytes.Buffer
+	slog.New(slog.NewTextHandler(&buf, nil)).Info("test", "credentials", creds)
+	if strings.Contains(buf.String(), "secret") {
+		t.Errorf("credentials were logged: %s", buf.String())
+	}
+
+	for _, key := range []string{"ACCESS_TOKENS", "SUBSTITUTERS", "TRUSTED_PUBLIC_KEYS"} {
+		previous := os.Getenv("NIXERY_" + key)
+		t.Setenv("NIXERY_"+key, previous+"\nsandbox = false")
+		if _, err := credentialsFromEnv("NIXERY_"); err == nil {
+			t.Errorf("NIXERY_%s with additional settings was accepted", key)
+		}
+
+		t.Setenv("NIXERY_"+key, previous)
+	}
+
+	t.Setenv("NIXERY_ACCESS_TOKENS", "")
+	t.Setenv("NIXERY_SSH_KEY", filepath.Join(dir, "missing"))
+	if _, err := credentialsFromEnv("NIXERY_"); err == nil {
+		t.Error("missing SSH key was accepted")
+	}
+}
@@ -3,12 +3,18 @@
 package config
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"log/slog"
 )
@@ -30,10 +36,60 @@ type PkgSource interface {
 	CacheKey(pkgs []string, tag string) string
 }
 
+// TagChecker is implemented by package sources that only accept some
+// image tags.
+type TagChecker interface {
+	// CheckTag returns an error describing why a tag can not be
+	// built from this package source.
+	CheckTag(tag string) error
+}
+
+// Resolver is implemented by package sources whose tags select moving
+// targets, such as git branches. Resolve fixes the version of the
+// package set selected by a tag, and the returned package source is
+// used for all steps of a single build.
+//
+// An error means that the tag does not select any version of the
+// package set.
+type Resolver interface {
+	Resolve(tag string) (PkgSource, error)
+}
+
+// Labeler is implemented by package sources that can describe the
+// version of the package set used for a tag. The labels are added to
+// the configuration of built images.
+type Labeler interface {
+	Labels(tag string) map[string]string
+}
+
+// GitSource imports the package set from a git repository, using the
+// image tag as the git reference.
+//
+// Branches and tags are resolved to commits before building, so that
+// builds can be cached by commit.
 type GitSource struct {
 	repository string
+	creds      *Credentials
+
+	mu       sync.Mutex
+	resolved map[string]*gitRef
+}
+
+// gitRef is a git reference resolved to a commit.
+type gitRef struct {
+	name       string // full name of the reference, empty for HEAD
+	commit     string
+	resolvedAt time.Time
 }
 
+// Resolved references are reused for a short while, so that not every
+// request needs to list the references of the repository.
+const gitRefTTL = time.Minute
+
+// Listing the references of a repository is aborted after this time,
+// as requests resolving the same reference wait for it.
+const gitTimeout = 30 * time.Second
+
 // Regex to determine whether a git reference is a commit hash or
 // something else (branch/tag).
 //
@@ -44,19 +100,174 @@ type GitSource struct {
 // and references it intentionally, this heuristic will fail.
 var commitRegex = regexp.MustCompile(`^[0-9a-f]{40}$`)
 
+func NewGitSource(repository string, creds *Credentials) *GitSource {
+	return &GitSource{
+		repository: repository,
+		creds:      creds,
+		resolved:   make(map[string]*gitRef),
+	}
+}
+
+// lsRemote resolves a reference of a git repository to a commit. The
+// reference is either "HEAD" or the short or full name of a branch or
+// tag, and nil is returned if it does not exist.
+func lsRemote(repository, ref string, creds *Credentials) (*gitRef, error) {
+	// Annotated tags are only peeled to their commit if that is
+	// requested explicitly.
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "git", "ls-remote", "--", repository, ref, ref+"^{}")
+	cmd.Env = creds.Env()
+
+	// Processes started by git, such as SSH, might keep the output
+	// open after git has been killed.
+	cmd.WaitDelay = time.Second
+	out, err := cmd.Output()
+	if err != nil {
+		var stderr string
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			stderr = strings.TrimSpace(string(exitErr.Stderr))
+		}
+
+		return nil, fmt.Errorf("failed to list references of %s: %w (%s)", repository, err, stderr)
+	}
+
+	refs := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if commit, name, found := strings.Cut(line, "\t"); found {
+			refs[name] = commit
+		}
+	}
+
+	if ref == "HEAD" {
+		if commit, ok := refs["HEAD"]; ok {
+			return &gitRef{commit: commit}, nil
+		}
+
+		return nil, nil
+	}
+
+	// Branches take precedence over tags of the same name, as they
+	// do for Nix.
+	candidates := []string{ref, "refs/heads/" + ref, "refs/tags/" + ref}
+	for _, name := range candidates {
+		if commit, ok := refs[name+"^{}"]; ok {
+			return &gitRef{name: name, commit: commit}, nil
+		}
+
+		if commit, ok := refs[name]; ok && strings.HasPrefix(name, "refs/") {
+			return &gitRef{name: name, commit: commit}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// resolve returns the commit selected by an image tag. References that
+// do not exist resolve to nil.
+func (g *GitSource) resolve(tag string) (*gitRef, error) {
+	if commitRegex.MatchString(tag) {
+		return &gitRef{commit: tag}, nil
+	}
+
+	// If the user has not specified a non-default tag, it is
+	// assumed that the implicit 'HEAD' of the repository should
+	// be used.
+	ref := tag
+	if tag == "latest" || tag == "" {
+		ref = "HEAD"
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if r, ok := g.resolved[ref]; ok && time.Since(r.resolvedAt) < gitRefTTL {
+		return r, nil
+	}
+
+	r, err := lsRemote(g.repository, ref, g.creds)
+	if err != nil || r == nil {
+		return nil, err
+	}
+
+	if previous, ok := g.resolved[ref]; !ok || previous.commit != r.commit {
+		slog.Info("resolved git reference", "repo", g.repository, "ref", ref, "commit", r.commit)
+	}
+
+	r.resolvedAt = time.Now()
+	g.resolved[ref] = r
+
+	return r, nil
+}
+
+// gitRevision is a git package source resolved for a single build.
+type gitRevision struct {
+	repository string
+	tag        string
+	ref        *gitRef // nil if the reference could not be resolved
+}
+
+// revision resolves the reference selected by a tag. References that
+// can not be resolved are passed to Nix as they are, as it may still
+// be able to fetch them, for example if it uses other credentials.
+func (g *GitSource) revision(tag string) (*gitRevision, error) {
+	rev := &gitRevision{repository: g.repository, tag: tag}
+
+	r, err := g.resolve(tag)
+	if err != nil {
+		slog.Warn("failed to resolve git reference", "err", err, "repo", g.repository, "tag", tag)
+		return rev, nil
+	}
+
+	if r == nil {
+		return rev, fmt.Errorf("git reference %q does not exist in %s", tag, g.repository)
+	}
+
+	rev.ref = r
+	return rev, nil
+}
+
+func (g *GitSource) Resolve(tag string) (PkgSource, error) {
+	rev, err := g.revision(tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return rev, nil
+}
+
 func (g *GitSource) Render(tag string) (string, string) {
+	rev, _ := g.revision(tag)
+	return rev.Render(tag)
+}
+
+func (g *GitSource) Labels(tag string) map[string]string {
+	rev, _ := g.revision(tag)
+	return rev.Labels(tag)
+}
+
+func (g *GitSource) CacheKey(pkgs []string, tag string) string {
+	rev, _ := g.revision(tag)
+	return rev.CacheKey(pkgs, tag)
+}
+
+// The methods of a resolved revision ignore the tag, as it has been
+// resolved already.
+func (r *gitRevision) Render(string) (string, string) {
 	args := map[string]string{
-		"url": g.repository,
+		"url": r.repository,
 	}
 
-	// If the user has not specified a non-default tag,
-	// it is assumed that the implicit 'HEAD' of the repository should be used.
-	if tag != "latest" && tag != "" {
-		if commitRegex.MatchString(tag) {
-			args["rev"] = tag
-		} else {
-			args["ref"] = tag
+	if r.ref != nil {
+		// Nix only finds commits outside of the default branch
+		// if the reference they are on is specified, too.
+		args["rev"] = r.ref.commit
+		if r.ref.name != "" {
+			args["ref"] = r.ref.name
 		}
+	} else if r.tag != "latest" && r.tag != "" {
+		args["ref"] = r.tag
 	}
 
 	j, _ := json.Marshal(args)
@@ -64,43 +275,254 @@ func (g *GitSource) Render(tag string) (string, string) {
 	return "git", string(j)
 }
 
-func (g *GitSource) CacheKey(pkgs []string, tag string) string {
-	// Only full commit hashes can be used for caching, as
-	// everything else is potentially a moving target.
-	if !commitRegex.MatchString(tag) {
+func (r *gitRevision) Labels(string) map[string]string {
+	if r.ref == nil {
+		return nil
+	}
+
+	return map[string]string{
+		"org.opencontainers.image.revision": r.ref.commit,
+	}
+}
+
+func (r *gitRevision) CacheKey(pkgs []string, _ string) string {
+	// Only commits can be used for caching, as everything else is
+	// potentially a moving target.
+	if r.ref == nil {
 		return ""
 	}
 
-	unhashed := strings.Join(pkgs, "") + tag
+	unhashed := strings.Join(pkgs, "") + r.ref.commit
 	hashed := fmt.Sprintf("%x", sha1.Sum([]byte(unhashed)))
 
 	return hashed
 }
 
+// NixChannel imports nixpkgs from a channel or commit on Github.
+//
+// The image tag selects the revision: The default channel is used for
+// "latest", commit hashes pin that commit and configured aliases (such
+// as "stable" or "24.05") map to other channels. Other tags are
+// rejected.
+//
+// Channels are pinned to their current commit if a pinner is
+// configured.
 type NixChannel struct {
 	channel string
+	aliases map[string]string
+	pinner  *channelPinner
+}
+
+// channelFor returns the channel or commit that is used for a tag.
+func (n *NixChannel) channelFor(tag string) (string, bool) {
+	if tag == "latest" || tag == "" {
+		return n.channel, true
+	}
+
+	if channel, ok := n.aliases[tag]; ok {
+		return channel, true
+	}
+
+	if commitRegex.MatchString(tag) {
+		return tag, true
+	}
+
+	return "", false
+}
+
+func (n *NixChannel) CheckTag(tag string) error {
+	if _, ok := n.channelFor(tag); !ok {
+		return fmt.Errorf("tag %q is neither a nixpkgs commit nor a configured channel alias", tag)
+	}
+
+	return nil
+}
+
+// channelRevision is the channel or commit of a nixpkgs package source
+// resolved for a single build.
+type channelRevision string
+
+// revision returns the channel or commit that is used for a tag, with
+// channels pinned to their current commit where possible.
+func (n *NixChannel) revision(tag string) channelRevision {
+	channel, ok := n.channelFor(tag)
+	if !ok || n.pinner == nil || commitRegex.MatchString(channel) {
+		return channelRevision(channel)
+	}
+
+	commit, err := n.pinner.pin(channel)
+	if err != nil {
+		slog.Warn("failed to pin nixpkgs channel, build is not cacheable", "err", err, "channel", channel)
+		return channelRevision(channel)
+	}
+
+	return channelRevision(commit)
+}
+
+func (n *NixChannel) Resolve(tag string) (PkgSource, error) {
+	if err := n.CheckTag(tag); err != nil {
+		return nil, err
+	}
+
+	return n.revision(tag), nil
 }
 
 func (n *NixChannel) Render(tag string) (string, string) {
-	return "nixpkgs", n.channel
+	return n.revision(tag).Render(tag)
+}
+
+func (n *NixChannel) Labels(tag string) map[string]string {
+	return n.revision(tag).Labels(tag)
 }
 
 func (n *NixChannel) CacheKey(pkgs []string, tag string) string {
+	return n.revision(tag).CacheKey(pkgs, tag)
+}
+
+// The methods of a resolved revision ignore the tag, as it has been
+// resolved already.
+func (c channelRevision) Render(string) (string, string) {
+	return "nixpkgs", string(c)
+}
+
+func (c channelRevision) Labels(string) map[string]string {
+	if !commitRegex.MatchString(string(c)) {
+		return nil
+	}
+
+	return map[string]string{
+		"org.opencontainers.image.revision": string(c),
+	}
+}
+
+func (c channelRevision) CacheKey(pkgs []string, _ string) string {
 	// Since Nix channels are downloaded from the nixpkgs-channels
 	// Github, users can specify full commit hashes as the
-	// "channel", in which case builds are cacheable.
-	if !commitRegex.MatchString(n.channel) {
+	// "channel", in which case builds are cacheable. Pinned
+	// channels are cached by their current commit.
+	if !commitRegex.MatchString(string(c)) {
 		return ""
 	}
 
-	unhashed := strings.Join(pkgs, "") + n.channel
+	unhashed := strings.Join(pkgs, "") + string(c)
 	hashed := fmt.Sprintf("%x", sha1.Sum([]byte(unhashed)))
 
 	return hashed
 }
 
+// PkgsPath imports the package set from a local path.
+//
+// Builds are cached by the state of the path, which is its git HEAD if
+// it is a clean git checkout, and the hash of its contents otherwise.
 type PkgsPath struct {
 	path string
+
+	mu     sync.Mutex
+	state  string
+	hash   string // hashed state, reused for pathStateTTL
+	hashAt time.Time
+}
+
+// Hashing the contents of a path is expensive for large package sets,
+// so the hash is reused for a short while. Builds started within that
+// time after the path changed are cached under the previous hash.
+const pathStateTTL = time.Minute
+
+// isGitRoot checks whether a path is the top-level directory of a git
+// checkout.
+func isGitRoot(path string, git func(...string) (string, error)) bool {
+	top, err := git("rev-parse", "--show-toplevel")
+	if err != nil {
+		return false
+	}
+
+	// git reports the top-level directory with symlinks resolved.
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+
+	abs, err := filepath.Abs(resolved)
+	return err == nil && filepath.Clean(top) == abs
+}
+
+// gitState returns the commit of a local package set, if it is
+// identified by it.
+func gitState(path string) (string, bool) {
+	git := func(args ...string) (string, error) {
+		out, err := exec.Command("git", append([]string{"-C", path}, args...)...).Output()
+		return strings.TrimSpace(string(out)), err
+	}
+
+	// The commit only identifies the package set if it is the root
+	// of the checkout, and no files are changed or ignored. Nix
+	// imports ignored files as well.
+	if !isGitRoot(path, git) {
+		return "", false
+	}
+
+	head, err := git("rev-parse", "HEAD")
+	if err != nil {
+		return "", false
+	}
+
+	status, err := git("status", "--porcelain", "--ignored", "--", ".")
+	if err != nil || status != "" {
+		return "", false
+	}
+
+	return "git:" + head, true
+}
+
+// hashState returns the hash of the contents of a local package set.
+// Directories are hashed by Nix, like it does when importing them.
+func hashState(path string) (string, error) {
+	out, err := exec.Command("nix-hash", "--type", "sha256", path).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to hash package set at %s: %w", path, err)
+	}
+
+	return "nar:" + strings.TrimSpace(string(out)), nil
+}
+
+// pathState returns a string identifying the contents of a local
+// package set.
+func pathState(path string) (string, error) {
+	if state, ok := gitState(path); ok {
+		return state, nil
+	}
+
+	return hashState(path)
+}
+
+// currentState returns the state of the path. Clean git checkouts are
+// checked on every request, as this is cheap.
+func (p *PkgsPath) currentState() (string, error) {
+	state, ok := gitState(p.path)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !ok {
+		if p.hash == "" || time.Since(p.hashAt) >= pathStateTTL {
+			hash, err := hashState(p.path)
+			if err != nil {
+				return "", err
+			}
+
+			p.hash = hash
+			p.hashAt = time.Now()
+		}
+
+		state = p.hash
+	}
+
+	if state != p.state {
+		slog.Info("determined state of local package set", "path", p.path, "state", state)
+		p.state = state
+	}
+
+	return state, nil
 }
 
 func (p *PkgsPath) Render(tag string) (string, string) {
@@ -108,32 +530,337 @@ func (p *PkgsPath) Render(tag string) (string, string) {
 }
 
 func (p *PkgsPath) CacheKey(pkgs []string, tag string) string {
-	// Path-based builds are not currently cacheable because we
-	// have no local hash of the package folder's state easily
-	// available.
-	return ""
+	state, err := p.currentState()
+	if err != nil {
+		slog.Warn("state of local package set is unknown, build is not cacheable", "err", err, "path", p.path)
+		return ""
+	}
+
+	unhashed := strings.Join(pkgs, "") + p.path + state
+	hashed := fmt.Sprintf("%x", sha1.Sum([]byte(unhashed)))
+
+	return hashed
+}
+
+// FlakeSource imports the package set from the outputs of a Nix flake,
+// such as "github:NixOS/nixpkgs/nixos-unstable" or "path:/src/pkgs".
+//
+// The flake reference is locked before it is used, and the NAR hash
+// of the lock makes builds cacheable even if the reference points to
+// a moving target.
+type FlakeSource struct {
+	ref string
+
+	// Locks the flake reference. This is done by Nix, except in
+	// tests.
+	resolve func(ref string) (*flakeLock, error)
+
+	mu       sync.Mutex
+	locked   *flakeLock
+	lockedAt time.Time
+}
+
+// flakeLock describes a locked flake reference.
+type flakeLock struct {
+	URL     string // locked flake reference, passed to Nix
+	NarHash string
+	Rev     string // only set for flakes from version control
+}
+
+// Locks are reused for a short while, so that not every request has to
+// run Nix. Builds use the lock they were resolved with.
+const flakeLockTTL = time.Minute
+
+func NewFlakeSource(ref string, creds *Credentials) *FlakeSource {
+	return &FlakeSource{
+		ref: ref,
+		resolve: func(ref string) (*flakeLock, error) {
+			return lockFlake(ref, creds)
+		},
+	}
+}
+
+// lockFlake asks Nix to lock a flake reference.
+func lockFlake(ref string, creds *Credentials) (*flakeLock, error) {
+	cmd := exec.Command("nix", "--extra-experimental-features", "nix-command flakes", "flake", "metadata", "--json", ref)
+	cmd.Env = creds.Env()
+	out, err := cmd.Output()
+	if err != nil {
+		var stderr string
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			stderr = strings.TrimSpace(string(exitErr.Stderr))
+		}
+
+		return nil, fmt.Errorf("failed to lock flake %q: %w (%s)", ref, err, stderr)
+	}
+
+	return parseFlakeMetadata(ref, out)
+}
+
+// parseFlakeMetadata reads the lock of a flake from the output of
+// "nix flake metadata --json".
+func parseFlakeMetadata(ref string, out []byte) (*flakeLock, error) {
+	var metadata struct {
+		URL       string `json:"url"`
+		LockedURL string `json:"lockedUrl"` // used by older Nix versions
+		Locked    struct {
+			NarHash string `json:"narHash"`
+			Rev     string `json:"rev"`
+		} `json:"locked"`
+	}
+	if err := json.Unmarshal(out, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata of flake %q: %w", ref, err)
+	}
+
+	lock := &flakeLock{
+		URL:     metadata.URL,
+		NarHash: metadata.Locked.NarHash,
+		Rev:     metadata.Locked.Rev,
+	}
+
+	if lock.URL == "" {
+		lock.URL = metadata.LockedURL
+	}
+
+	if lock.URL == "" || lock.NarHash == "" {
+		return nil, fmt.Errorf("Nix returned no lock for flake %q", ref)
+	}
+
+	return lock, nil
+}
+
+func (f *FlakeSource) lock() (*flakeLock, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.locked != nil && time.Since(f.lockedAt) < flakeLockTTL {
+		return f.locked, nil
+	}
+
+	lock, err := f.resolve(f.ref)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.locked == nil || f.locked.NarHash != lock.NarHash {
+		slog.Info("locked flake package source", "flake", f.ref, "url", lock.URL, "rev", lock.Rev, "narHash", lock.NarHash)
+	}
+
+	f.locked = lock
+	f.lockedAt = time.Now()
+
+	return lock, nil
+}
+
+// flakeRevision is a flake package source locked for a single build.
+type flakeRevision struct {
+	ref  string
+	lock *flakeLock // nil if the flake could not be locked
+}
+
+func (f *FlakeSource) revision() *flakeRevision {
+	lock, err := f.lock()
+	if err != nil {
+		slog.Warn("failed to lock flake, build is not cacheable", "err", err, "flake", f.ref)
+		return &flakeRevision{ref: f.ref}
+	}
+
+	return &flakeRevision{ref: f.ref, lock: lock}
+}
+
+func (f *FlakeSource) Resolve(tag string) (PkgSource, error) {
+	return f.revision(), nil
+}
+
+func (f *FlakeSource) Render(tag string) (string, string) {
+	return f.revision().Render(tag)
+}
+
+func (f *FlakeSource) CacheKey(pkgs []string, tag string) string {
+	return f.revision().CacheKey(pkgs, tag)
+}
+
+func (r *flakeRevision) Render(string) (string, string) {
+	// Nix can still evaluate the unlocked reference, but the
+	// result is not cacheable.
+	if r.lock == nil {
+		return "flake", r.ref
+	}
+
+	return "flake", r.lock.URL
+}
+
+func (r *flakeRevision) CacheKey(pkgs []string, _ string) string {
+	if r.lock == nil {
+		return ""
+	}
+
+	unhashed := strings.Join(pkgs, "") + r.lock.NarHash
+	hashed := fmt.Sprintf("%x", sha1.Sum([]byte(unhashed)))
+
+	return hashed
+}
+
+// TarballSource imports the package set from a tarball (such as a
+// mirrored nixpkgs archive) with a known hash. As Nix verifies the
+// hash of the fetched tarball, builds are always cacheable.
+type TarballSource struct {
+	url    string
+	sha256 string
+}
+
+// Regex matching the formats in which Nix accepts SHA256 hashes:
+// base16, Nix's base32 and SRI.
+var sha256Regex = regexp.MustCompile(`^([0-9a-f]{64}|[0-9a-df-np-sv-z]{52}|sha256-[A-Za-z0-9+/]{43}=)$`)
+
+func (t *TarballSource) Render(tag string) (string, string) {
+	args := map[string]string{
+		"url":    t.url,
+		"sha256": t.sha256,
+	}
+
+	j, _ := json.Marshal(args)
+
+	return "tarball", string(j)
+}
+
+func (t *TarballSource) CacheKey(pkgs []string, tag string) string {
+	unhashed := strings.Join(pkgs, "") + t.sha256
+	hashed := fmt.Sprintf("%x", sha1.Sum([]byte(unhashed)))
+
+	return hashed
+}
+
+// NixpkgsArgs configures how nixpkgs is imported by a package source.
+type NixpkgsArgs struct {
+	Config   string   // Path to a Nix file containing the nixpkgs configuration
+	Overlays []string // Paths to Nix files containing overlays
+}
+
+// Hash returns a hash of the contents of the configured files, which is
+// part of the cache key of builds using them. Files imported by these
+// files are not included.
+func (a *NixpkgsArgs) Hash() (string, error) {
+	h := sha1.New()
+
+	for _, path := range append([]string{a.Config}, a.Overlays...) {
+		if path == "" {
+			fmt.Fprint(h, "\x00")
+			continue
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read nixpkgs configuration: %w", err)
+		}
+
+		fmt.Fprintf(h, "%s\x00%d\x00", path, len(content))
+		h.Write(content)
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// Retrieve the nixpkgs configuration of a package source from the
+// environment variables starting with the given prefix. Nil is
+// returned if neither a configuration nor overlays are set.
+func nixpkgsArgsFromEnv(prefix string, src PkgSource) (*NixpkgsArgs, error) {
+	var args NixpkgsArgs
+
+	absolute := func(key, path string) (string, error) {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return "", fmt.Errorf("invalid path %q in %s: %w", path, key, err)
+		}
+
+		return abs, nil
+	}
+
+	if path := os.Getenv(prefix + "NIXPKGS_CONFIG"); path != "" {
+		abs, err := absolute(prefix+"NIXPKGS_CONFIG", path)
+		if err != nil {
+			return nil, err
+		}
+
+		args.Config = abs
+	}
+
+	for _, path := range strings.Split(os.Getenv(prefix+"NIXPKGS_OVERLAYS"), ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+
+		abs, err := absolute(prefix+"NIXPKGS_OVERLAYS", path)
+		if err != nil {
+			return nil, err
+		}
+
+		args.Overlays = append(args.Overlays, abs)
+	}
+
+	if args.Config == "" && len(args.Overlays) == 0 {
+		return nil, nil
+	}
+
+	// Flakes are evaluated purely, and their outputs can not be
+	// configured.
+	if _, ok := src.(*FlakeSource); ok {
+		return nil, fmt.Errorf("%sNIXPKGS_CONFIG and %sNIXPKGS_OVERLAYS are not supported for flakes", prefix, prefix)
+	}
+
+	// Missing files are reported early, instead of failing builds.
+	if _, err := args.Hash(); err != nil {
+		return nil, err
+	}
+
+	slog.Info("using nixpkgs configuration", "config", args.Config, "overlays", args.Overlays)
+
+	return &args, nil
 }
 
-// Retrieve a package source from the environment. If no source is
-// specified, the Nix code will default to a recent NixOS channel.
-func pkgSourceFromEnv() (PkgSource, error) {
-	if channel := os.Getenv("NIXERY_CHANNEL"); channel != "" {
-		slog.Info("using Nix package set from Nix channel or commit", "channel", channel)
+// errNoPkgSource is returned if no package source is configured.
+var errNoPkgSource = errors.New("no valid package source has been specified")
+
+// Retrieve a package source from the environment variables starting
+// with the given prefix, which is "NIXERY_" for the default source.
+// Sources that fetch from outside of Nix do so with the credentials of
+// the source.
+func pkgSourceFromEnv(prefix string, creds *Credentials) (PkgSource, error) {
+	if channel := os.Getenv(prefix + "CHANNEL"); channel != "" {
+		aliases, err := getMapping(prefix + "CHANNEL_ALIASES")
+		if err != nil {
+			return nil, err
+		}
+
+		refresh, err := getDuration(prefix+"CHANNEL_REFRESH", 5*time.Minute)
+		if err != nil {
+			return nil, err
+		}
+
+		// Pinning channels to commits can be disabled by
+		// setting the refresh interval to zero.
+		var pinner *channelPinner
+		if refresh > 0 {
+			resolver := getConfig(prefix+"CHANNEL_RESOLVER", "channel resolver URL", "https://channels.nixos.org")
+			pinner = newChannelPinner(resolver, os.Getenv(prefix+"CHANNEL_PINS"), refresh)
+		}
+
+		slog.Info("using Nix package set from Nix channel or commit", "channel", channel, "aliases", aliases, "pinned", pinner != nil)
 
 		return &NixChannel{
 			channel: channel,
+			aliases: aliases,
+			pinner:  pinner,
 		}, nil
 	}
 
-	if git := os.Getenv("NIXERY_PKGS_REPO"); git != "" {
+	if git := os.Getenv(prefix + "PKGS_REPO"); git != "" {
 		slog.Info("using Nix package set from git repository", "repo", git)
 
-		return &GitSource{
-			repository: git,
-		}, nil
+		return NewGitSource(git, creds), nil
 	}
 
-	if path := os.Getenv("NIXERY_PKGS_PATH"); path != "" {
+	if path := os.Getenv(prefix + "PKGS_PATH"); path != "" {
 		slog.Info("using Nix package set at local path", "path", path)
 
 		return &PkgsPath{
@@ -141,5 +868,112 @@ func pkgSourceFromEnv() (PkgSource, error) {
 		}, nil
 	}
 
-	return nil, fmt.Errorf("no valid package source has been specified")
+	if flake := os.Getenv(prefix + "FLAKE"); flake != "" {
+		slog.Info("using Nix package set from flake", "flake", flake)
+
+		return NewFlakeSource(flake, creds), nil
+	}
+
+	if tarball := os.Getenv(prefix + "PKGS_TARBALL"); tarball != "" {
+		sha256 := os.Getenv(prefix + "PKGS_TARBALL_SHA256")
+		if !sha256Regex.MatchString(sha256) {
+			return nil, fmt.Errorf("%sPKGS_TARBALL_SHA256 must be set to the SHA256 hash of the tarball, got %q", prefix, sha256)
+		}
+
+		slog.Info("using Nix package set from tarball", "url", tarball, "sha256", sha256)
+
+		return &TarballSource{
+			url:    tarball,
+			sha256: sha256,
+		}, nil
+	}
+
+	return nil, errNoPkgSource
+}
+
+// Regex matching valid names of package sources, which are used as the
+// first component of image names.
+var sourceNameRegex = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*$`)
+
+// IsMetaPackage reports whether a name is one of the meta-packages
+// defined by Nixery, such as "shell". Package sources can not be named
+// like them, as both are selected by the first component of image
+// names.
+func IsMetaPackage(name string) bool {
+	switch name {
+	case "shell", "arm64":
+		return true
+	}
+
+	return false
+}
+
+// namedSources holds the configuration of the named package sources.
+type namedSources struct {
+	sources     map[string]PkgSource
+	nixpkgsArgs map[string]*NixpkgsArgs
+	credentials map[string]*Credentials
+}
+
+// Retrieve the named package sources listed in NIXERY_SOURCES, their
+// nixpkgs configuration and credentials from the environment. Each
+// source is configured with the same variables as the default source,
+// prefixed with NIXERY_SOURCE_<NAME>_.
+func namedPkgSourcesFromEnv() (*namedSources, error) {
+	named := &namedSources{
+		sources:     make(map[string]PkgSource),
+		nixpkgsArgs: make(map[string]*NixpkgsArgs),
+		credentials: make(map[string]*Credentials),
+	}
+
+	// Names are mapped to the prefix of their variables, which is
+	// the same for names that only differ in punctuation.
+	prefixes := make(map[string]string)
+
+	for _, name := range strings.Split(os.Getenv("NIXERY_SOURCES"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		if !sourceNameRegex.MatchString(name) {
+			return nil, fmt.Errorf("invalid package source name %q in NIXERY_SOURCES", name)
+		}
+
+		if IsMetaPackage(name) {
+			return nil, fmt.Errorf("package source name %q in NIXERY_SOURCES is reserved for a meta-package", name)
+		}
+
+		prefix := "NIXERY_SOURCE_" + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name)) + "_"
+		if other, ok := prefixes[prefix]; ok {
+			return nil, fmt.Errorf("package sources %q and %q in NIXERY_SOURCES are both configured by %s* variables", other, name, prefix)
+		}
+		prefixes[prefix] = name
+		creds, err := credentialsFromEnv(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("package source %q (%s*): %w", name, prefix, err)
+		}
+
+		src, err := pkgSourceFromEnv(prefix, creds)
+		if err != nil {
+			return nil, fmt.Errorf("package source %q (%s*): %w", name, prefix, err)
+		}
+
+		args, err := nixpkgsArgsFromEnv(prefix, src)
+		if err != nil {
+			return nil, fmt.Errorf("package source %q (%s*): %w", name, prefix, err)
+		}
+
+		slog.Info("configured named package source", "source", name, "credentials", creds)
+		named.sources[name] = src
+		if args != nil {
+			named.nixpkgsArgs[name] = args
+		}
+
+		if creds != nil {
+			named.credentials[name] = creds
+		}
+	}
+
+	return named, nil
 }
@@ -0,0 +1,613 @@
+// Copyright The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package config
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFlakeSource(t *testing.T) {
+	lock := &flakeLock{
+		URL:     "github:example/pkgs/0123456789abcdef0123456789abcdef01234567?narHash=sha256-one",
+		NarHash: "sha256-one",
+		Rev:     "0123456789abcdef0123456789abcdef01234567",
+	}
+
+	resolves := 0
+	src := NewFlakeSource("github:example/pkgs", nil)
+	src.resolve = func(ref string) (*flakeLock, error) {
+		resolves++
+		return lock, nil
+	}
+
+	srcType, srcArgs := src.Render("latest")
+	if srcType != "flake" || srcArgs != lock.URL {
+		t.Errorf("flake was not rendered with its locked URL: %s %s", srcType, srcArgs)
+	}
+
+	key := src.CacheKey([]string{"hello"}, "latest")
+	if key == "" {
+		t.Fatal("locked flake is not cacheable")
+	}
+
+	if resolves != 1 {
+		t.Errorf("flake was locked %d times within one request", resolves)
+	}
+
+	// Resolved flakes keep their lock, even if the flake changes.
+	resolved, err := src.Resolve("latest")
+	if err != nil {
+		t.Fatalf("failed to resolve flake: %s", err)
+	}
+
+	// A changed lock yields a new cache key once the previous lock
+	// has expired.
+	lock = &flakeLock{URL: "path:/src?narHash=sha256-two", NarHash: "sha256-two"}
+	src.lockedAt = src.lockedAt.Add(-flakeLockTTL)
+
+	if src.CacheKey([]string{"hello"}, "latest") == key {
+		t.Error("cache key did not change with the flake lock")
+	}
+
+	if _, srcArgs := resolved.Render("latest"); srcArgs != "github:example/pkgs/0123456789abcdef0123456789abcdef01234567?narHash=sha256-one" {
+		t.Errorf("resolved flake was rendered with another lock: %s", srcArgs)
+	}
+
+	if resolved.CacheKey([]string{"hello"}, "latest") != key {
+		t.Error("cache key of resolved flake changed with the flake lock")
+	}
+
+	// Flakes that can not be locked are still built, but not cached.
+	src.resolve = func(ref string) (*flakeLock, error) {
+		return nil, errors.New("no network")
+	}
+	src.lockedAt = src.lockedAt.Add(-flakeLockTTL)
+
+	if _, srcArgs := src.Render("latest"); srcArgs != "github:example/pkgs" {
+		t.Errorf("unlockable flake was not rendered unlocked: %s", srcArgs)
+	}
+
+	if key := src.CacheKey([]string{"hello"}, "latest"); key != "" {
+		t.Errorf("unlockable flake has cache key %q", key)
+	}
+}
+
+func TestParseFlakeMetadata(t *testing.T) {
+	// Recorded output of "nix flake metadata --json" for a flake on
+	// GitHub, trimmed to the relevant fields.
+	current := `{
+  "description": "A collection of packages for the Nix package manager",
+  "lastModified": 1717179513,
+  "locked": {
+    "lastModified": 1717179513,
+    "narHash": "sha256-vboIEwIQojofItm2xGCdZCzW96U85l9nDW3ifMuAIdM=",
+    "owner": "NixOS",
+    "repo": "nixpkgs",
+    "rev": "63dacb46bf939521bdc93981b4cbb7ecb58427a0",
+    "type": "github"
+  },
+  "original": {
+    "owner": "NixOS",
+    "ref": "24.05",
+    "repo": "nixpkgs",
+    "type": "github"
+  },
+  "originalUrl": "github:NixOS/nixpkgs/24.05",
+  "path": "/nix/store/5w2xdwsv3ghmrrpmyn9kmjvqzw1n5cdr-source",
+  "resolvedUrl": "github:NixOS/nixpkgs/24.05",
+  "revision": "63dacb46bf939521bdc93981b4cbb7ecb58427a0",
+  "url": "github:NixOS/nixpkgs/63dacb46bf939521bdc93981b4cbb7ecb58427a0?narHash=sha256-vboIEwIQojofItm2xGCdZCzW96U85l9nDW3ifMuAIdM%3D"
+}`
+
+	lock, err := parseFlakeMetadata("github:NixOS/nixpkgs/24.05", []byte(current))
+	if err != nil {
+		t.Fatalf("failed to parse flake metadata: %s", err)
+	}
+
+	expected := flakeLock{
+		URL:     "github:NixOS/nixpkgs/63dacb46bf939521bdc93981b4cbb7ecb58427a0?narHash=sha256-vboIEwIQojofItm2xGCdZCzW96U85l9nDW3ifMuAIdM%3D",
+		NarHash: "sha256-vboIEwIQojofItm2xGCdZCzW96U85l9nDW3ifMuAIdM=",
+		Rev:     "63dacb46bf939521bdc93981b4cbb7ecb58427a0",
+	}
+	if diff := cmp.Diff(expected, *lock); diff != "" {
+		t.Errorf("unexpected lock of flake:\n%s", diff)
+	}
+
+	// Older Nix versions report the locked reference as lockedUrl,
+	// and flakes outside of version control have no revision.
+	older := `{
+  "locked": {
+    "lastModified": 1717179513,
+    "narHash": "sha256-k3hYjsPpQmgCvZw6j1I4yT0Hoq1TkBK1W7oSHg4vzSY=",
+    "path": "/src/pkgs",
+    "type": "path"
+  },
+  "lockedUrl": "path:/src/pkgs?lastModified=1717179513&narHash=sha256-k3hYjsPpQmgCvZw6j1I4yT0Hoq1TkBK1W7oSHg4vzSY%3D",
+  "original": {
+    "path": "/src/pkgs",
+    "type": "path"
+  },
+  "originalUrl": "path:/src/pkgs",
+  "path": "/nix/store/0vbk5n8j0dk1gfw0ix7d6cp0jkbwx3rs-source"
+}`
+
+	lock, err = parseFlakeMetadata("path:/src/pkgs", []byte(older))
+	if err != nil {
+		t.Fatalf("failed to parse flake metadata of older Nix: %s", err)
+	}
+
+	expected = flakeLock{
+		URL:     "path:/src/pkgs?lastModified=1717179513&narHash=sha256-k3hYjsPpQmgCvZw6j1I4yT0Hoq1TkBK1W7oSHg4vzSY%3D",
+		NarHash: "sha256-k3hYjsPpQmgCvZw6j1I4yT0Hoq1TkBK1W7oSHg4vzSY=",
+	}
+	if diff := cmp.Diff(expected, *lock); diff != "" {
+		t.Errorf("unexpected lock of flake from older Nix:\n%s", diff)
+	}
+
+	// Unlocked flakes are not usable for caching.
+	unlocked := `{"original": {"path": "/src/pkgs", "type": "path"}, "url": "path:/src/pkgs"}`
+	if _, err := parseFlakeMetadata("path:/src/pkgs", []byte(unlocked)); err == nil {
+		t.Error("flake metadata without a lock was accepted")
+	}
+}
+
+func TestTarballSourceFromEnv(t *testing.T) {
+	t.Setenv("NIXERY_PKGS_TARBALL", "file:///mirror/nixpkgs.tar.gz")
+	t.Setenv("NIXERY_PKGS_TARBALL_SHA256", "not-a-hash")
+
+	if _, err := pkgSourceFromEnv("NIXERY_", nil); err == nil {
+		t.Error("tarball source with invalid hash was accepted")
+	}
+
+	hash := "0a3kgkfjxnm7jpqm4dwpwgfizsmzpqxllkpwqarsqc4dg9lqm8rn"
+	t.Setenv("NIXERY_PKGS_TARBALL_SHA256", hash)
+
+	src, err := pkgSourceFromEnv("NIXERY_", nil)
+	if err != nil {
+		t.Fatalf("failed to configure tarball source: %s", err)
+	}
+
+	srcType, srcArgs := src.Render("latest")
+	expected := `{"sha256":"` + hash + `","url":"file:///mirror/nixpkgs.tar.gz"}`
+	if srcType != "tarball" || srcArgs != expected {
+		t.Errorf("unexpected rendering of tarball source: %s %s", srcType, srcArgs)
+	}
+
+	if src.CacheKey([]string{"hello"}, "latest") == "" {
+		t.Error("tarball source is not cacheable")
+	}
+}
+
+func TestNixChannelTags(t *testing.T) {
+	t.Setenv("NIXERY_CHANNEL", "nixos-unstable")
+	t.Setenv("NIXERY_CHANNEL_ALIASES", "stable=nixos-24.05, 24.05=nixos-24.05,pinned=0123456789abcdef0123456789abcdef01234567")
+	t.Setenv("NIXERY_CHANNEL_REFRESH", "0")
+
+	src, err := pkgSourceFromEnv("NIXERY_", nil)
+	if err != nil {
+		t.Fatalf("failed to configure channel source: %s", err)
+	}
+
+	commit := "fedcba9876543210fedcba9876543210fedcba98"
+	cases := map[string]string{
+		"latest": "nixos-unstable",
+		"stable": "nixos-24.05",
+		"24.05":  "nixos-24.05",
+		"pinned": "0123456789abcdef0123456789abcdef01234567",
+		commit:   commit,
+	}
+
+	for tag, expected := range cases {
+		if err := src.(TagChecker).CheckTag(tag); err != nil {
+			t.Errorf("tag %q was rejected: %s", tag, err)
+		}
+
+		if _, channel := src.Render(tag); channel != expected {
+			t.Errorf("tag %q rendered channel %q, expected %q", tag, channel, expected)
+		}
+	}
+
+	if err := src.(TagChecker).CheckTag("23.11"); err == nil {
+		t.Error("unknown tag was accepted")
+	}
+
+	// Only tags resolving to commits are cacheable.
+	if src.CacheKey([]string{"hello"}, "stable") != "" {
+		t.Error("build from channel alias is cacheable")
+	}
+
+	if src.CacheKey([]string{"hello"}, "pinned") == "" || src.CacheKey([]string{"hello"}, commit) == "" {
+		t.Error("build from commit is not cacheable")
+	}
+
+	t.Setenv("NIXERY_CHANNEL_ALIASES", "stable")
+	if _, err := pkgSourceFromEnv("NIXERY_", nil); err == nil {
+		t.Error("malformed channel aliases were accepted")
+	}
+}
+
+// runGit runs a git command in a directory, returning its output.
+func runGit(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v failed: %s (%s)", args, err, out)
+	}
+
+	return strings.TrimSpace(string(out))
+}
+
+func TestPkgsPathCacheKey(t *testing.T) {
+	dir := t.TempDir()
+	git := func(args ...string) {
+		runGit(t, dir, args...)
+	}
+
+	write := func(content string) {
+		if err := os.WriteFile(filepath.Join(dir, "default.nix"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	git("init", "-q")
+	write("{ }: { }")
+	git("add", "default.nix")
+	git("commit", "-q", "-m", "initial")
+
+	src := &PkgsPath{path: dir}
+	key := src.CacheKey([]string{"hello"}, "latest")
+	if key == "" {
+		t.Fatal("clean git checkout is not cacheable")
+	}
+
+	if src.CacheKey([]string{"hello"}, "latest") != key {
+		t.Error("cache key of unchanged checkout is not stable")
+	}
+
+	// Local changes must not share the key of the commit, whether
+	// or not nix-hash is available to hash them.
+	write("{ }: { hello = 42; }")
+
+	if src.CacheKey([]string{"hello"}, "latest") == key {
+		t.Error("cache key did not change with local changes")
+	}
+
+	// Commits are picked up immediately.
+	git("commit", "-q", "-a", "-m", "change")
+
+	committed := src.CacheKey([]string{"hello"}, "latest")
+	if committed == "" || committed == key {
+		t.Errorf("unexpected cache key %q after new commit", committed)
+	}
+
+	// Ignored files are imported by Nix, and subdirectories of a
+	// checkout are not identified by its commit.
+	if err := os.WriteFile(filepath.Join(dir, ".gitignore"), []byte("*.local\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git("add", ".gitignore")
+	git("commit", "-q", "-m", "ignore")
+
+	if state, err := pathState(dir); err != nil || !strings.HasPrefix(state, "git:") {
+		t.Fatalf("clean checkout is not identified by its commit: %q (%v)", state, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "overlay.local"), []byte("{ }"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := pathState(dir); err == nil && strings.HasPrefix(state, "git:") {
+		t.Errorf("checkout with ignored files is identified by its commit")
+	}
+
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := pathState(sub); err == nil && strings.HasPrefix(state, "git:") {
+		t.Errorf("subdirectory of checkout is identified by its commit")
+	}
+}
+
+func TestGitSourceResolution(t *testing.T) {
+	work, bare := t.TempDir(), t.TempDir()
+	git := func(args ...string) string {
+		return runGit(t, work, args...)
+	}
+
+	git("init", "-q", "-b", "main")
+	git("commit", "-q", "--allow-empty", "-m", "initial")
+	git("tag", "-a", "-m", "release", "v1")
+	initial := git("rev-parse", "HEAD")
+
+	git("checkout", "-q", "-b", "feature")
+	git("commit", "-q", "--allow-empty", "-m", "feature")
+	feature := git("rev-parse", "HEAD")
+	git("checkout", "-q", "main")
+
+	runGit(t, bare, "clone", "-q", "--bare", work, ".")
+
+	src := NewGitSource(bare, nil)
+
+	cases := map[string]struct {
+		commit string
+		args   string
+	}{
+		"latest":  {initial, `{"rev":"` + initial + `","url":"` + bare + `"}`},
+		"v1":      {initial, `{"ref":"refs/tags/v1","rev":"` + initial + `","url":"` + bare + `"}`},
+		"feature": {feature, `{"ref":"refs/heads/feature","rev":"` + feature + `","url":"` + bare + `"}`},
+		feature:   {feature, `{"rev":"` + feature + `","url":"` + bare + `"}`},
+	}
+
+	for tag, expected := range cases {
+		if _, err := src.Resolve(tag); err != nil {
+			t.Errorf("tag %q was rejected: %s", tag, err)
+		}
+
+		if _, args := src.Render(tag); args != expected.args {
+			t.Errorf("unexpected rendering of tag %q: %s", tag, args)
+		}
+
+		if rev := src.Labels(tag)["org.opencontainers.image.revision"]; rev != expected.commit {
+			t.Errorf("tag %q is labelled with revision %q, expected %q", tag, rev, expected.commit)
+		}
+	}
+
+	// Tags resolving to the same commit share a cache key.
+	key := src.CacheKey([]string{"hello"}, "latest")
+	if key == "" || key != src.CacheKey([]string{"hello"}, initial) {
+		t.Errorf("unexpected cache key %q for latest", key)
+	}
+
+	if _, err := src.Resolve("missing"); err == nil {
+		t.Error("missing git reference was accepted")
+	}
+
+	// Moving references are resolved again once they expire, but a
+	// resolved revision keeps referring to the same commit.
+	resolved, err := src.Resolve("latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	git("commit", "-q", "--allow-empty", "-m", "update")
+	git("push", "-q", bare, "main")
+
+	if src.CacheKey([]string{"hello"}, "latest") != key {
+		t.Error("resolved reference was not reused")
+	}
+
+	for _, r := range src.resolved {
+		r.resolvedAt = r.resolvedAt.Add(-gitRefTTL)
+	}
+
+	if src.CacheKey([]string{"hello"}, "latest") == key {
+		t.Error("moved reference was not resolved again")
+	}
+
+	_, args := resolved.Render("latest")
+	if resolved.CacheKey([]string{"hello"}, "latest") != key || args != cases["latest"].args {
+		t.Errorf("resolved revision changed with its reference: %s", args)
+	}
+}
+
+func TestChannelPinning(t *testing.T) {
+	first, second := strings.Repeat("1", 40), strings.Repeat("2", 40)
+
+	commit := first
+	var failed atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/nixos-unstable/git-revision" {
+			failed.Add(1)
+			http.NotFound(w, r)
+			return
+		}
+
+		io.WriteString(w, commit)
+	}))
+	defer srv.Close()
+
+	t.Setenv("NIXERY_CHANNEL", "nixos-unstable")
+	t.Setenv("NIXERY_CHANNEL_ALIASES", "stable=nixos-24.05")
+	t.Setenv("NIXERY_CHANNEL_RESOLVER", srv.URL)
+
+	src, err := pkgSourceFromEnv("NIXERY_", nil)
+	if err != nil {
+		t.Fatalf("failed to configure channel source: %s", err)
+	}
+	channel := src.(*NixChannel)
+
+	if _, rev := src.Render("latest"); rev != first {
+		t.Errorf("channel was not pinned to its commit: %s", rev)
+	}
+
+	key := src.CacheKey([]string{"hello"}, "latest")
+	if key == "" {
+		t.Fatal("pinned channel is not cacheable")
+	}
+
+	// Pins are kept until they are refreshed.
+	commit = second
+	if src.CacheKey([]string{"hello"}, "latest") != key {
+		t.Error("pin was not kept within the refresh interval")
+	}
+
+	resolved, err := channel.Resolve("latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channel.pinner.pinned["nixos-unstable"].pinnedAt = time.Time{}
+	if _, rev := src.Render("latest"); rev != second {
+		t.Errorf("pin was not refreshed: %s", rev)
+	}
+
+	// A resolved channel keeps the pin it was resolved with.
+	if _, rev := resolved.Render("latest"); rev != first || resolved.CacheKey([]string{"hello"}, "latest") != key {
+		t.Errorf("resolved channel changed with its pin: %s", rev)
+	}
+
+	if _, err := channel.Resolve("23.11"); err == nil {
+		t.Error("unknown tag was resolved")
+	}
+
+	// Failed lookups are not retried immediately.
+	for i := 0; i < 2; i++ {
+		if _, rev := src.Render("stable"); rev != "nixos-24.05" {
+			t.Errorf("channel that can not be pinned was rendered as %s", rev)
+		}
+	}
+
+	if n := failed.Load(); n != 1 {
+		t.Errorf("failed lookup was retried, %d lookups", n)
+	}
+
+	// Outdated pins are kept if the resolver fails, and channels
+	// that can not be pinned are built without caching.
+	srv.Close()
+	channel.pinner.pinned["nixos-unstable"].pinnedAt = time.Time{}
+	if _, rev := src.Render("latest"); rev != second {
+		t.Errorf("outdated pin was not kept: %s", rev)
+	}
+
+	if _, rev := src.Render("stable"); rev != "nixos-24.05" || src.CacheKey([]string{"hello"}, "stable") != "" {
+		t.Errorf("unpinned channel was rendered as %s", rev)
+	}
+
+	// Pins can be read from a file instead.
+	pins := filepath.Join(t.TempDir(), "pins.json")
+	if err := os.WriteFile(pins, []byte(`{"nixos-24.05":"`+first+`"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("NIXERY_CHANNEL_PINS", pins)
+	if src, err = pkgSourceFromEnv("NIXERY_", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, rev := src.Render("stable"); rev != first {
+		t.Errorf("channel was not pinned from file: %s", rev)
+	}
+}
+
+func TestNamedSources(t *testing.T) {
+	t.Setenv("NIXERY_SOURCES", "stable, nixos-unstable")
+	t.Setenv("NIXERY_SOURCE_STABLE_CHANNEL", "nixos-24.05")
+	t.Setenv("NIXERY_SOURCE_STABLE_CHANNEL_REFRESH", "0")
+	t.Setenv("NIXERY_SOURCE_NIXOS_UNSTABLE_PKGS_PATH", "/src/pkgs")
+
+	named, err := namedPkgSourcesFromEnv()
+	if err != nil {
+		t.Fatalf("failed to configure named sources: %s", err)
+	}
+
+	cfg := Config{Sources: named.sources}
+
+	cases := map[string][2]string{
+		"stable/hello":           {"stable", "hello"},
+		"nixos-unstable/git/vim": {"nixos-unstable", "git/vim"},
+		"hello/stable":           {"", "hello/stable"},
+		"stable":                 {"", "stable"},
+	}
+
+	for name, expected := range cases {
+		if source, rest := cfg.SplitSource(name); source != expected[0] || rest != expected[1] {
+			t.Errorf("unexpected split of %q: %q %q", name, source, rest)
+		}
+	}
+
+	if _, channel := cfg.PkgSource("stable").Render("latest"); channel != "nixos-24.05" {
+		t.Errorf("stable source was not configured from its variables: %s", channel)
+	}
+
+	if srcType, _ := cfg.PkgSource("nixos-unstable").Render("latest"); srcType != "path" {
+		t.Errorf("unexpected type of nixos-unstable source: %s", srcType)
+	}
+
+	if cfg.PkgSource("") != nil {
+		t.Error("default source is set without being configured")
+	}
+
+	t.Setenv("NIXERY_SOURCES", "stable,internal")
+	if _, err := namedPkgSourcesFromEnv(); err == nil {
+		t.Error("unconfigured named source was accepted")
+	}
+
+	// Names sharing the prefix of their variables are rejected.
+	t.Setenv("NIXERY_SOURCES", "nixos-unstable, nixos.unstable")
+	if _, err := namedPkgSourcesFromEnv(); err == nil {
+		t.Error("package sources with colliding variables were accepted")
+	}
+
+	// Names of meta-packages would select the source instead.
+	for _, name := range []string{"shell", "arm64"} {
+		t.Setenv("NIXERY_SOURCES", name)
+		t.Setenv("NIXERY_SOURCE_"+strings.ToUpper(name)+"_CHANNEL", "nixos-24.05")
+		if _, err := namedPkgSourcesFromEnv(); err == nil {
+			t.Errorf("package source named like meta-package %q was accepted", name)
+		}
+	}
+}
+
+func TestNixpkgsArgs(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		return p
+	}
+
+	config := write("config.nix", "{ allowUnfree = true; }")
+	overlay := write("overlay.nix", "self: super: { }")
+
+	t.Setenv("NIXERY_SOURCES", "internal")
+	t.Setenv("NIXERY_SOURCE_INTERNAL_PKGS_PATH", dir)
+	t.Setenv("NIXERY_SOURCE_INTERNAL_NIXPKGS_CONFIG", config)
+	t.Setenv("NIXERY_SOURCE_INTERNAL_NIXPKGS_OVERLAYS", overlay+", "+overlay)
+
+	named, err := namedPkgSourcesFromEnv()
+	if err != nil {
+		t.Fatalf("failed to configure nixpkgs arguments: %s", err)
+	}
+
+	args := named.nixpkgsArgs["internal"]
+	if args == nil || args.Config != config || len(args.Overlays) != 2 {
+		t.Fatalf("unexpected nixpkgs arguments: %+v", args)
+	}
+
+	hash, err := args.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write("overlay.nix", "self: super: { openssl = super.openssl; }")
+	if changed, _ := args.Hash(); changed == hash {
+		t.Error("hash did not change with overlay")
+	}
+
+	t.Setenv("NIXERY_SOURCE_INTERNAL_NIXPKGS_CONFIG", filepath.Join(dir, "missing.nix"))
+	if _, err := namedPkgSourcesFromEnv(); err == nil {
+		t.Error("missing nixpkgs configuration was accepted")
+	}
+
+	t.Setenv("NIXERY_SOURCE_INTERNAL_PKGS_PATH", "")
+	t.Setenv("NIXERY_SOURCE_INTERNAL_FLAKE", "path:"+dir)
+	t.Setenv("NIXERY_SOURCE_INTERNAL_NIXPKGS_CONFIG", config)
+	if _, err := namedPkgSourcesFromEnv(); err == nil {
+		t.Error("nixpkgs configuration was accepted for flake")
+	}
+}
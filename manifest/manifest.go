@@ -21,20 +21,90 @@ const (
 	LayerType    = "application/vnd.docker.image.rootfs.diff.tar.gzip"
 	configType   = "application/vnd.docker.container.image.v1+json"
 
+	// OCI media types, used for images with zstd-compressed layers
+	OCIManifestType = "application/vnd.oci.image.manifest.v1+json"
+	ZstdLayerType   = "application/vnd.oci.image.layer.v1.tar+zstd"
+	ociLayerType    = "application/vnd.oci.image.layer.v1.tar+gzip"
+	ociConfigType   = "application/vnd.oci.image.config.v1+json"
+
 	// image config constants
 	os     = "linux"
 	fsType = "layers"
+
+	// MaxSize is the size of the largest manifest that is read back
+	// from storage, as registries commonly reject larger manifests.
+	MaxSize = 4 << 20
+)
+
+// Compression represents the compression algorithms supported for
+// image layers.
+type Compression int
+
+const (
+	Gzip Compression = iota
+	Zstd
+
+	// eStargz layers are gzip-compressed, but contain a table of
+	// contents that allows lazy pulling.
+	Estargz
 )
 
+func (c Compression) String() string {
+	switch c {
+	case Zstd:
+		return "zstd"
+	case Estargz:
+		return "estargz"
+	default:
+		return "gzip"
+	}
+}
+
+// ManifestType returns the media type of manifests referencing layers
+// with this compression.
+//
+// zstd-compressed layers and layer annotations are only defined for
+// OCI images, clients that do not accept OCI manifests are served
+// gzip-compressed images.
+func (c Compression) ManifestType() string {
+	if c == Zstd || c == Estargz {
+		return OCIManifestType
+	}
+
+	return ManifestType
+}
+
+// LayerType returns the media type of layers with this compression.
+func (c Compression) LayerType() string {
+	switch c {
+	case Zstd:
+		return ZstdLayerType
+	case Estargz:
+		return ociLayerType
+	default:
+		return LayerType
+	}
+}
+
+func (c Compression) configType() string {
+	if c.ManifestType() == OCIManifestType {
+		return ociConfigType
+	}
+
+	return configType
+}
+
 type Entry struct {
-	MediaType string `json:"mediaType,omitempty"`
-	Size      int64  `json:"size"`
-	Digest    string `json:"digest"`
+	MediaType   string            `json:"mediaType,omitempty"`
+	Size        int64             `json:"size"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations,omitempty"`
 
 	// These fields are internal to Nixery and not part of the
 	// serialised entry.
 	MergeRating uint64 `json:"-"`
 	TarHash     string `json:",omitempty"`
+	CreatedBy   string `json:"-"`
 }
 
 type manifest struct {
@@ -54,9 +124,21 @@ type imageConfig struct {
 	} `json:"rootfs"`
 
 	Config struct {
-		Cmd []string `json:",omitempty"`
-		Env []string `json:",omitempty"`
+		Cmd    []string          `json:",omitempty"`
+		Env    []string          `json:",omitempty"`
+		Labels map[string]string `json:",omitempty"`
 	} `json:"config"`
+
+	History []history `json:"history,omitempty"`
+}
+
+// history describes the origin of a single layer in the image
+// configuration. Entries are in the same order as the layers in the
+// manifest and are what `docker history` displays.
+type history struct {
+	CreatedBy  string `json:"created_by,omitempty"`
+	Comment    string `json:"comment,omitempty"`
+	EmptyLayer bool   `json:"empty_layer,omitempty"`
 }
 
 // ConfigLayer represents the configuration layer to be included in
@@ -73,16 +155,32 @@ type ConfigLayer struct {
 // Outside of this module the image configuration is treated as an
 // opaque blob and it is thus returned as an already serialised byte
 // array and its SHA256-hash.
-func configLayer(arch string, hashes []string, cmd string) ConfigLayer {
+func configLayer(arch string, layers []Entry, cmd string, labels map[string]string) ConfigLayer {
 	c := imageConfig{}
 	c.Architecture = arch
 	c.OS = os
 	c.RootFS.FSType = fsType
-	c.RootFS.DiffIDs = hashes
+
+	for _, l := range layers {
+		c.RootFS.DiffIDs = append(c.RootFS.DiffIDs, l.TarHash)
+		c.History = append(c.History, history{
+			CreatedBy: l.CreatedBy,
+			Comment:   fmt.Sprintf("%d bytes", l.Size),
+		})
+	}
+
 	if cmd != "" {
 		c.Config.Cmd = []string{cmd}
+
+		// Setting the command does not create a layer, but is
+		// recorded for parity with images built by Docker.
+		c.History = append(c.History, history{
+			CreatedBy:  fmt.Sprintf("nixery: CMD [%q]", cmd),
+			EmptyLayer: true,
+		})
 	}
 	c.Config.Env = []string{"SSL_CERT_FILE=/etc/ssl/certs/ca-bundle.crt"}
+	c.Config.Labels = labels
 
 	j, _ := json.Marshal(c)
 
@@ -96,8 +194,11 @@ func configLayer(arch string, hashes []string, cmd string) ConfigLayer {
 // and returns its JSON-serialised form as well as the configuration
 // layer.
 //
-// Callers do not need to set the media type for the layer entries.
-func Manifest(arch string, layers []Entry, cmd string) (json.RawMessage, ConfigLayer) {
+// Callers do not need to set the media type for the layer entries,
+// it is derived from the compression used for the layers. The
+// `CreatedBy` field of each entry is used to populate the image
+// history, and labels are added to the image configuration.
+func Manifest(arch string, layers []Entry, cmd string, labels map[string]string, compression Compression) (json.RawMessage, ConfigLayer) {
 	// Sort layers by their merge rating, from highest to lowest.
 	// This makes it likely for a contiguous chain of shared image
 	// layers to appear at the beginning of a layer.
@@ -108,21 +209,19 @@ func Manifest(arch string, layers []Entry, cmd string) (json.RawMessage, ConfigL
 		return layers[i].MergeRating > layers[j].MergeRating
 	})
 
-	hashes := make([]string, len(layers))
+	c := configLayer(arch, layers, cmd, labels)
+
 	for i, l := range layers {
-		hashes[i] = l.TarHash
-		l.MediaType = LayerType
+		l.MediaType = compression.LayerType()
 		l.TarHash = ""
 		layers[i] = l
 	}
 
-	c := configLayer(arch, hashes, cmd)
-
 	m := manifest{
 		SchemaVersion: schemaVersion,
-		MediaType:     ManifestType,
+		MediaType:     compression.ManifestType(),
 		Config: Entry{
-			MediaType: configType,
+			MediaType: compression.configType(),
 			Size:      int64(len(c.Config)),
 			Digest:    "sha256:" + c.SHA256,
 		},
@@ -0,0 +1,50 @@
+// Copyright The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package manifest
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestManifestHistory(t *testing.T) {
+	layers := []Entry{
+		{
+			Digest:      "sha256:aaaa",
+			Size:        10,
+			TarHash:     "sha256:1111",
+			MergeRating: 1,
+			CreatedBy:   "nixery: hello-2.12",
+		},
+		{
+			Digest:      "sha256:bbbb",
+			Size:        20,
+			TarHash:     "sha256:2222",
+			MergeRating: 2,
+			CreatedBy:   "nixery: glibc-2.38",
+		},
+	}
+
+	_, c := Manifest("amd64", layers, "bash", nil, Gzip)
+
+	var config imageConfig
+	if err := json.Unmarshal(c.Config, &config); err != nil {
+		t.Fatalf("failed to unmarshal image config: %s", err)
+	}
+
+	expected := []history{
+		{CreatedBy: "nixery: glibc-2.38", Comment: "20 bytes"},
+		{CreatedBy: "nixery: hello-2.12", Comment: "10 bytes"},
+		{CreatedBy: `nixery: CMD ["bash"]`, EmptyLayer: true},
+	}
+
+	if diff := cmp.Diff(expected, config.History); diff != "" {
+		t.Fatalf("image history mismatch:\n%s", diff)
+	}
+
+	if diff := cmp.Diff([]string{"sha256:2222", "sha256:1111"}, config.RootFS.DiffIDs); diff != "" {
+		t.Fatalf("diff IDs do not match layer order:\n%s", diff)
+	}
+}
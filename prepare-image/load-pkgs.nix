@@ -2,7 +2,7 @@
 # SPDX-License-Identifier: Apache-2.0
 
 # Load a Nix package set from one of the supported source types
-# (nixpkgs, git, path).
+# (nixpkgs, git, path, flake, tarball).
 { srcType, srcArgs, importArgs ? { } }:
 
 with builtins;
@@ -25,6 +25,29 @@ let
   # No special handling is used for paths, so users are expected to pass one
   # that will work natively with Nix.
   importPath = path: import (toPath path) importArgs;
+
+  # Tarballs are fetched with their expected hash, which makes the
+  # fetch a fixed-output derivation that is only downloaded once.
+  # This works for file:// URLs as well.
+  fetchImportTarball = spec: import (fetchTarball spec) importArgs;
+
+  # Flakes are referenced by their locked URL and evaluated purely, so
+  # only the target system is taken from the import arguments.
+  # Packages are looked up in the flake's outputs for that system, on
+  # top of its nixpkgs input (if any) which provides the library
+  # functions and tools used to assemble images.
+  importFlake = url:
+    let
+      flake = getFlake url;
+      system = importArgs.system or currentSystem;
+      nixpkgs =
+        if flake ? inputs.nixpkgs
+        then flake.inputs.nixpkgs.legacyPackages.${system} or { }
+        else { };
+    in
+    nixpkgs
+    // (flake.legacyPackages.${system} or { })
+    // (flake.packages.${system} or { });
 in
 if srcType == "nixpkgs" then
   fetchImportChannel srcArgs
@@ -32,5 +55,9 @@ else if srcType == "git" then
   fetchImportGit (fromJSON srcArgs)
 else if srcType == "path" then
   importPath srcArgs
+else if srcType == "flake" then
+  importFlake srcArgs
+else if srcType == "tarball" then
+  fetchImportTarball (fromJSON srcArgs)
 else
   throw ("Invalid package set source specification: ${srcType} (${srcArgs})")
@@ -16,6 +16,12 @@
 , srcArgs ? "nixos-unstable"
 , system ? "x86_64-linux"
 , importArgs ? { }
+, # Path to a file containing the nixpkgs configuration (such as
+  # `{ allowUnfree = true; }`), passed to nixpkgs if set.
+  nixpkgsConfig ? ""
+, # Paths to files containing nixpkgs overlays. This is passed in as a
+  # JSON-array in string form.
+  overlays ? "[]"
 , # Path to load-pkgs.nix
   loadPkgs ? ./load-pkgs.nix
 , # Packages to install by name (which must refer to top-level attributes of
@@ -34,8 +40,17 @@ let
     toFile
     toJSON;
 
+  # The nixpkgs configuration and overlays configured in Nixery are
+  # passed to nixpkgs in addition to the import arguments.
+  pkgsImportArgs = importArgs
+    // (if nixpkgsConfig != "" then { config = import nixpkgsConfig; } else { })
+    // (if fromJSON overlays != [ ] then { overlays = map import (fromJSON overlays); } else { });
+
   # Package set to use for sourcing utilities
-  nativePkgs = import loadPkgs { inherit srcType srcArgs importArgs; };
+  nativePkgs = import loadPkgs {
+    inherit srcType srcArgs;
+    importArgs = pkgsImportArgs;
+  };
   inherit (nativePkgs) coreutils jq openssl lib runCommand writeText symlinkJoin;
 
   # Package set to use for packages to be included in the image. This
@@ -43,7 +58,7 @@ let
   # architecture.
   pkgs = import loadPkgs {
     inherit srcType srcArgs;
-    importArgs = importArgs // {
+    importArgs = pkgsImportArgs // {
       inherit system;
     };
   };
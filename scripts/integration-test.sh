@@ -10,12 +10,9 @@ echo "Loaded Nixery image as ${IMG}"
 
 # Run the built nixery docker image in the background, but keep printing its
 # output as it occurs.
-# We can't just mount a tmpfs to /var/cache/nixery, as tmpfs doesn't support
-# user xattrs.
-# So create a temporary directory in the current working directory, and hope
-# it's backed by something supporting user xattrs.
-# We'll notice it isn't if nixery starts complaining about not able to set
-# xattrs anyway.
+# A temporary directory in the current working directory is used instead of a
+# tmpfs, as it is usually backed by something supporting user xattrs. Nixery
+# falls back to sidecar metadata files if it isn't.
 if [ -d var-cache-nixery ]; then rm -Rf var-cache-nixery; fi
 mkdir var-cache-nixery
 docker run --privileged --rm -p 8080:8080 --name nixery \
@@ -6,18 +6,48 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/pkg/xattr"
 	"log/slog"
 )
 
+// Content types of objects are stored in user xattrs where the
+// filesystem supports them, and in sidecar files otherwise.
+const (
+	xattrMetadata   = "xattr"
+	sidecarMetadata = "sidecar"
+)
+
+// Directory inside of the storage path that holds sidecar metadata
+// files, mirroring the layout of the stored objects.
+const sidecarDir = ".metadata"
+
+// File inside of the storage path that records which metadata mode
+// the storage directory was last used with.
+const metadataModeFile = ".metadata-mode"
+
+// Directory inside of the storage path in which files are written
+// before they are moved into place. It is on the same filesystem as
+// the objects, which makes the final rename atomic.
+const tempDir = ".tmp"
+
+// Temporary files older than this at startup were left behind by a
+// crashed writer.
+const staleTempAge = time.Hour
+
 type FSBackend struct {
-	path string
+	path     string
+	metadata string
 }
 
 func NewFSBackend() (*FSBackend, error) {
@@ -26,42 +56,269 @@ func NewFSBackend() (*FSBackend, error) {
 		return nil, fmt.Errorf("STORAGE_PATH must be set for filesystem storage")
 	}
 
+	return newFSBackend(p, os.Getenv("STORAGE_METADATA"))
+}
+
+// newFSBackend opens a storage directory with the given metadata
+// mode, which is detected automatically if it is empty or "auto".
+func newFSBackend(p, metadata string) (*FSBackend, error) {
 	p = path.Clean(p)
 	err := os.MkdirAll(p, 0755)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create storage dir: %s", err)
 	}
 
-	return &FSBackend{p}, nil
+	b := &FSBackend{path: p}
+	if err := b.removeStaleTemp(); err != nil {
+		return nil, fmt.Errorf("failed to clean up temporary files: %w", err)
+	}
+
+	switch m := metadata; m {
+	case "", "auto":
+		b.metadata, err = detectMetadataMode(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to probe storage dir: %w", err)
+		}
+	case xattrMetadata, sidecarMetadata:
+		b.metadata = m
+	default:
+		return nil, fmt.Errorf("STORAGE_METADATA must be one of auto, xattr or sidecar, got %q", m)
+	}
+
+	if err := b.migrateMetadata(); err != nil {
+		return nil, fmt.Errorf("failed to migrate object metadata: %w", err)
+	}
+
+	return b, nil
+}
+
+// detectMetadataMode checks whether the storage directory supports
+// user xattrs, which is not the case for tmpfs, many overlay
+// filesystems and some NFS mounts.
+func detectMetadataMode(dir string) (string, error) {
+	probe, err := os.CreateTemp(dir, ".xattr-probe-")
+	if err != nil {
+		return "", err
+	}
+	probe.Close()
+	defer os.Remove(probe.Name())
+
+	if err := xattr.Set(probe.Name(), "user.mime_type", []byte("text/plain")); err != nil {
+		slog.Info("storage dir does not support user xattrs, using sidecar metadata files", "path", dir, "err", err)
+		return sidecarMetadata, nil
+	}
+
+	return xattrMetadata, nil
+}
+
+// migrateMetadata copies the content types of all objects into the
+// current metadata mode, if the storage directory was previously used
+// with the other one.
+func (b *FSBackend) migrateMetadata() error {
+	modeFile := path.Join(b.path, metadataModeFile)
+
+	// Storage directories without a recorded mode predate sidecar
+	// metadata files, and can only have used xattrs.
+	previous := xattrMetadata
+	recorded, err := os.ReadFile(modeFile)
+	if err == nil {
+		previous = string(recorded)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if previous != b.metadata {
+		objects, err := b.List(context.Background(), "")
+		if err != nil {
+			return err
+		}
+
+		old := &FSBackend{path: b.path, metadata: previous}
+		for _, o := range objects {
+			contentType, err := old.contentType(o.Path)
+			if err != nil {
+				slog.Warn("failed to read object metadata during migration", "err", err, "key", o.Path)
+				continue
+			}
+
+			if err := b.setContentType(o.Path, path.Join(b.path, o.Path), contentType); err != nil {
+				return err
+			}
+		}
+
+		if previous == sidecarMetadata {
+			if err := os.RemoveAll(path.Join(b.path, sidecarDir)); err != nil {
+				return err
+			}
+		}
+
+		slog.Info("migrated object metadata", "from", previous, "to", b.metadata, "objects", len(objects))
+	}
+
+	return b.writeFile(modeFile, []byte(b.metadata))
+}
+
+func (b *FSBackend) removeStaleTemp() error {
+	dir := path.Join(b.path, tempDir)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < staleTempAge {
+			continue
+		}
+
+		slog.Warn("removing stale temporary file", "file", e.Name())
+		if err := os.Remove(path.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *FSBackend) createTemp() (*os.File, error) {
+	dir := path.Join(b.path, tempDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.CreateTemp(dir, "write-")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// commit durably moves a fully written temporary file into place.
+// Readers see either the previous file or the complete new one, and
+// the last of several concurrent writers wins.
+func commit(tmp *os.File, full string) error {
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	dir := path.Dir(full)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), full); err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir persists the directory entries of a directory, such as
+// files that were renamed into it.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// writeFile atomically replaces the file at full with the given data.
+func (b *FSBackend) writeFile(full string, data []byte) error {
+	tmp, err := b.createTemp()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	return commit(tmp, full)
+}
+
+func (b *FSBackend) sidecarPath(key string) string {
+	return path.Join(b.path, sidecarDir, key)
+}
+
+// setContentType stores the content type of an object, whose data is
+// currently in the file at p.
+func (b *FSBackend) setContentType(key, p, contentType string) error {
+	if b.metadata == xattrMetadata {
+		return xattr.Set(p, "user.mime_type", []byte(contentType))
+	}
+
+	return b.writeFile(b.sidecarPath(key), []byte(contentType))
+}
+
+func (b *FSBackend) contentType(key string) (string, error) {
+	var contentType []byte
+	var err error
+
+	if b.metadata == xattrMetadata {
+		contentType, err = xattr.Get(path.Join(b.path, key), "user.mime_type")
+	} else {
+		contentType, err = os.ReadFile(b.sidecarPath(key))
+	}
+
+	return string(contentType), err
 }
 
 func (b *FSBackend) Name() string {
 	return fmt.Sprintf("Filesystem (%s)", b.path)
 }
 
+// Persist writes the object to a temporary file, which is only moved
+// into place once it has been written completely.
 func (b *FSBackend) Persist(ctx context.Context, key, contentType string, f Persister) (string, int64, error) {
 	full := path.Join(b.path, key)
-	dir := path.Dir(full)
-	err := os.MkdirAll(dir, 0755)
+
+	file, err := b.createTemp()
 	if err != nil {
-		slog.Error("failed to create storage directory", "err", err, "path", dir)
+		slog.Error("failed to create temporary file", "err", err, "file", full)
 		return "", 0, err
 	}
+	defer os.Remove(file.Name())
 
-	file, err := os.OpenFile(full, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	hash, size, err := f(file)
 	if err != nil {
-		slog.Error("failed to write file", "err", err, "file", full)
-		return "", 0, err
+		file.Close()
+		return hash, size, err
 	}
-	defer file.Close()
 
-	err = xattr.Set(full, "user.mime_type", []byte(contentType))
+	// Sidecar metadata is written before the object is moved into
+	// place, so that objects are never visible without it.
+	err = b.setContentType(key, file.Name(), contentType)
 	if err != nil {
-		slog.Error("failed to store file type in xattrs", "err", err, "file", full)
+		file.Close()
+		slog.Error("failed to store file type", "err", err, "file", full, "metadata", b.metadata)
+		return "", 0, err
+	}
+
+	if err := commit(file, full); err != nil {
+		slog.Error("failed to write file", "err", err, "file", full)
 		return "", 0, err
 	}
 
-	return f(file)
+	return hash, size, nil
 }
 
 func (b *FSBackend) Fetch(ctx context.Context, key string) (io.ReadCloser, error) {
@@ -76,7 +333,26 @@ func (b *FSBackend) Move(ctx context.Context, old, new string) error {
 		return err
 	}
 
-	return os.Rename(path.Join(b.path, old), newpath)
+	if b.metadata == sidecarMetadata {
+		newsidecar := b.sidecarPath(new)
+		if err := os.MkdirAll(path.Dir(newsidecar), 0755); err != nil {
+			return err
+		}
+
+		if err := os.Rename(b.sidecarPath(old), newsidecar); err != nil {
+			return err
+		}
+
+		if err := syncDir(path.Dir(newsidecar)); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(path.Join(b.path, old), newpath); err != nil {
+		return err
+	}
+
+	return syncDir(path.Dir(newpath))
 }
 
 func (b *FSBackend) Serve(digest string, r *http.Request, w http.ResponseWriter) error {
@@ -84,13 +360,98 @@ func (b *FSBackend) Serve(digest string, r *http.Request, w http.ResponseWriter)
 
 	slog.Info("serving blob from filesystem", "digest", digest, "path", p)
 
-	contentType, err := xattr.Get(p, "user.mime_type")
+	contentType, err := b.contentType(path.Join("layers", digest))
 	if err != nil {
-		slog.Error("failed to read file type from xattrs", "err", err, "file", p)
+		slog.Error("failed to read file type", "err", err, "file", p, "metadata", b.metadata)
 		return err
 	}
-	w.Header().Add("Content-Type", string(contentType))
+	w.Header().Add("Content-Type", contentType)
 
 	http.ServeFile(w, r, p)
 	return nil
 }
+
+func (b *FSBackend) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	// Prefixes are not necessarily directories, so the walk starts
+	// at the closest parent directory.
+	root := path.Dir(path.Join(b.path, prefix+"x"))
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		key, err := filepath.Rel(b.path, p)
+		if err != nil {
+			return err
+		}
+
+		key = filepath.ToSlash(key)
+
+		// Hidden files and directories at the top of the storage
+		// path, such as sidecar metadata, are not objects.
+		if key != "." && strings.HasPrefix(key, ".") {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		objects = append(objects, ObjectInfo{
+			Path:     key,
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+		})
+
+		return nil
+	})
+
+	return objects, err
+}
+
+func (b *FSBackend) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := os.Stat(path.Join(b.path, key))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	// Objects without metadata have no known content type.
+	contentType, _ := b.contentType(key)
+
+	return ObjectInfo{
+		Path:        key,
+		Size:        info.Size(),
+		Modified:    info.ModTime(),
+		ContentType: contentType,
+	}, nil
+}
+
+func (b *FSBackend) Delete(ctx context.Context, key string) error {
+	if err := os.Remove(path.Join(b.path, key)); err != nil {
+		return err
+	}
+
+	if b.metadata == sidecarMetadata {
+		if err := os.Remove(b.sidecarPath(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,193 @@
+// Copyright The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/xattr"
+)
+
+func persistString(t *testing.T, b Backend, key, contentType, content string) {
+	_, _, err := b.Persist(context.Background(), key, contentType, func(w io.Writer) (string, int64, error) {
+		n, err := io.WriteString(w, content)
+		return "", int64(n), err
+	})
+	if err != nil {
+		t.Fatalf("failed to persist %s: %s", key, err)
+	}
+}
+
+func serveContentType(t *testing.T, b Backend, digest string) string {
+	rec := httptest.NewRecorder()
+	if err := b.Serve(digest, httptest.NewRequest("GET", "/", nil), rec); err != nil {
+		t.Fatalf("failed to serve %s: %s", digest, err)
+	}
+
+	return rec.Header().Get("Content-Type")
+}
+
+func TestFSBackendSidecarMetadata(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("STORAGE_PATH", dir)
+	t.Setenv("STORAGE_METADATA", "sidecar")
+
+	b, err := NewFSBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	persistString(t, b, "staging/abc", "application/x-test", "content")
+	if err := b.Move(ctx, "staging/abc", "layers/abc"); err != nil {
+		t.Fatalf("failed to move object: %s", err)
+	}
+
+	if ct := serveContentType(t, b, "abc"); ct != "application/x-test" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+
+	objects, err := b.List(ctx, "")
+	if err != nil {
+		t.Fatalf("failed to list objects: %s", err)
+	}
+
+	if len(objects) != 1 || objects[0].Path != "layers/abc" {
+		t.Fatalf("metadata files were listed as objects: %+v", objects)
+	}
+
+	if err := b.Delete(ctx, "layers/abc"); err != nil {
+		t.Fatalf("failed to delete object: %s", err)
+	}
+
+	if _, err := os.Stat(path.Join(dir, sidecarDir, "layers/abc")); !os.IsNotExist(err) {
+		t.Errorf("sidecar file of deleted object still exists: %v", err)
+	}
+}
+
+func TestFSBackendMetadataMigration(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("STORAGE_PATH", dir)
+
+	if mode, err := detectMetadataMode(dir); err != nil || mode != xattrMetadata {
+		t.Skipf("temporary directory does not support user xattrs (%v)", err)
+	}
+
+	t.Setenv("STORAGE_METADATA", "xattr")
+	b, err := NewFSBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	persistString(t, b, "layers/abc", "application/x-abc", "abc")
+	persistString(t, b, "layers/def", "application/x-def", "def")
+
+	expected := []string{"application/x-abc", "application/x-def"}
+	for _, mode := range []string{"sidecar", "xattr"} {
+		t.Setenv("STORAGE_METADATA", mode)
+
+		b, err := NewFSBackend()
+		if err != nil {
+			t.Fatalf("failed to migrate to %s metadata: %s", mode, err)
+		}
+
+		if mode == "sidecar" {
+			// Prevent the xattrs left behind from masking a
+			// failed migration.
+			for _, key := range []string{"layers/abc", "layers/def"} {
+				if err := xattr.Remove(path.Join(dir, key), "user.mime_type"); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		actual := []string{serveContentType(t, b, "abc"), serveContentType(t, b, "def")}
+		if diff := cmp.Diff(expected, actual); diff != "" {
+			t.Errorf("unexpected content types after migrating to %s metadata:\n%s", mode, diff)
+		}
+	}
+
+	if _, err := os.Stat(path.Join(dir, sidecarDir)); !os.IsNotExist(err) {
+		t.Errorf("sidecar metadata was not removed after migrating back to xattrs: %v", err)
+	}
+}
+
+func TestFSBackendAtomicWrites(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("STORAGE_PATH", dir)
+
+	b, err := NewFSBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	persistString(t, b, "builds/abc", "application/json", `{"complete":true}`)
+
+	// A failing writer must neither truncate the existing object
+	// nor expose its partial data.
+	_, _, err = b.Persist(ctx, "builds/abc", "application/json", func(w io.Writer) (string, int64, error) {
+		r, err := b.Fetch(ctx, "builds/abc")
+		if err != nil {
+			return "", 0, err
+		}
+		defer r.Close()
+
+		io.WriteString(w, `{"compl`)
+		existing, _ := io.ReadAll(r)
+		if string(existing) != `{"complete":true}` {
+			t.Errorf("partial object is visible during write: %q", existing)
+		}
+
+		return "", 0, errors.New("writer crashed")
+	})
+	if err == nil {
+		t.Fatal("failing writer did not return an error")
+	}
+
+	content, err := os.ReadFile(path.Join(dir, "builds/abc"))
+	if err != nil || string(content) != `{"complete":true}` {
+		t.Errorf("failed write modified existing object: %q (%v)", content, err)
+	}
+
+	temp, err := os.ReadDir(path.Join(dir, tempDir))
+	if err != nil || len(temp) != 0 {
+		t.Errorf("temporary files were left behind: %v (%v)", temp, err)
+	}
+
+	// Concurrent writers must not interleave.
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := b.Persist(ctx, "builds/def", "application/json", func(w io.Writer) (string, int64, error) {
+				n, err := io.WriteString(w, strings.Repeat(strconv.Itoa(i), 1<<16))
+				return "", int64(n), err
+			})
+			if err != nil {
+				t.Errorf("concurrent write failed: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	content, err = os.ReadFile(path.Join(dir, "builds/def"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(content) != 1<<16 || strings.Count(string(content), string(content[0])) != len(content) {
+		t.Errorf("concurrent writes were interleaved")
+	}
+}
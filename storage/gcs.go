@@ -16,6 +16,7 @@ import (
 
 	"cloud.google.com/go/storage"
 	"golang.org/x/oauth2/google"
+	"google.golang.org/api/iterator"
 )
 
 // HTTP client to use for direct calls to APIs that are not part of the SDK
@@ -167,6 +168,52 @@ func (b *GCSBackend) Serve(digest string, r *http.Request, w http.ResponseWriter
 	return nil
 }
 
+func (b *GCSBackend) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	it := b.handle.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, ObjectInfo{
+			Path:        attrs.Name,
+			Size:        attrs.Size,
+			Modified:    attrs.Updated,
+			ContentType: attrs.ContentType,
+		})
+	}
+
+	return objects, nil
+}
+
+func (b *GCSBackend) Stat(ctx context.Context, path string) (ObjectInfo, error) {
+	attrs, err := b.handle.Object(path).Attrs(ctx)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	return ObjectInfo{
+		Path:        attrs.Name,
+		Size:        attrs.Size,
+		Modified:    attrs.Updated,
+		ContentType: attrs.ContentType,
+	}, nil
+}
+
+func (b *GCSBackend) FetchRange(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	return b.handle.Object(path).NewRangeReader(ctx, offset, length)
+}
+
+func (b *GCSBackend) Delete(ctx context.Context, path string) error {
+	return b.handle.Object(path).Delete(ctx)
+}
+
 // Configure GCS URL signing in the presence of a service account key
 // (toggled if the user has set GOOGLE_APPLICATION_CREDENTIALS).
 func signingOptsFromEnv() (*storage.SignedURLOptions, error) {
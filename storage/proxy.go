@@ -0,0 +1,287 @@
+// Copyright The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+
+// Proxied blob serving for storage backends that otherwise redirect
+// clients to the storage service.
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RangeFetcher is implemented by storage backends that can retrieve a
+// part of an object without fetching all of it.
+type RangeFetcher interface {
+	// FetchRange retrieves length bytes of an object, starting at
+	// the given offset.
+	FetchRange(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error)
+}
+
+// ProxyOptions configures which blob requests are streamed through
+// Nixery instead of being redirected.
+type ProxyOptions struct {
+	// Proxy blob requests from all clients.
+	Always bool
+
+	// Proxy blob requests from clients in these networks.
+	Networks []*net.IPNet
+
+	// Reverse proxies in these networks are trusted to report the
+	// address of their client in X-Forwarded-For.
+	TrustedProxies []*net.IPNet
+
+	// Verify the digest of blobs that are served in full.
+	Verify bool
+}
+
+// ProxyBackend wraps a storage backend whose Serve method redirects
+// clients, and streams blobs through Nixery instead for clients that
+// can not follow redirects.
+type ProxyBackend struct {
+	Backend
+	opts ProxyOptions
+}
+
+func NewProxyBackend(b Backend, opts ProxyOptions) *ProxyBackend {
+	return &ProxyBackend{b, opts}
+}
+
+// proxies determines whether a request should be proxied.
+func (p *ProxyBackend) proxies(r *http.Request) bool {
+	if p.opts.Always {
+		return true
+	}
+
+	ip := p.clientIP(r)
+	if ip == nil {
+		return false
+	}
+
+	return contains(p.opts.Networks, ip)
+}
+
+func contains(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientIP determines the address of the client that sent a request.
+//
+// Requests from trusted reverse proxies are attributed to the last
+// address in X-Forwarded-For that is not a trusted proxy itself, as
+// only the addresses appended by trusted proxies can be relied on.
+func (p *ProxyBackend) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !contains(p.opts.TrustedProxies, ip) {
+		return ip
+	}
+
+	var forwarded []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(h, ",")...)
+	}
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			return nil
+		}
+
+		ip = hop
+		if !contains(p.opts.TrustedProxies, ip) {
+			break
+		}
+	}
+
+	return ip
+}
+
+func (p *ProxyBackend) Serve(digest string, r *http.Request, w http.ResponseWriter) error {
+	if !p.proxies(r) {
+		return p.Backend.Serve(digest, r, w)
+	}
+
+	ctx := r.Context()
+	key := "layers/" + digest
+
+	info, err := p.Stat(ctx, key)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return err
+	}
+
+	contentType := info.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	etag := `"sha256:` + digest + `"`
+	h := w.Header()
+	h.Set("Accept-Ranges", "bytes")
+	h.Set("Content-Type", contentType)
+	h.Set("Docker-Content-Digest", "sha256:"+digest)
+	h.Set("ETag", etag)
+	h.Set("Last-Modified", info.Modified.UTC().Format(http.TimeFormat))
+
+	status := http.StatusOK
+	offset, length := int64(0), info.Size
+
+	// Resumed downloads send a range, which is ignored if the blob
+	// changed since the download started.
+	if rng := r.Header.Get("Range"); rng != "" && ifRangeMatches(r.Header.Get("If-Range"), etag, info.Modified) {
+		start, end, ok := parseRange(rng, info.Size)
+		if !ok {
+			h.Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return nil
+		}
+
+		if start >= 0 {
+			status = http.StatusPartialContent
+			offset, length = start, end-start+1
+			h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, info.Size))
+		}
+	}
+
+	if r.Method == http.MethodHead {
+		h.Set("Content-Length", strconv.FormatInt(length, 10))
+		w.WriteHeader(status)
+		return nil
+	}
+
+	body, err := p.fetchRange(ctx, key, offset, length, info.Size)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return err
+	}
+	defer body.Close()
+
+	slog.Info("proxying blob from storage backend", "digest", digest, "offset", offset, "length", length)
+
+	h.Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(status)
+
+	if !p.opts.Verify || status != http.StatusOK || length == 0 {
+		_, err = io.CopyN(w, body, length)
+		return err
+	}
+
+	return verifiedCopy(w, body, digest, length)
+}
+
+func (p *ProxyBackend) fetchRange(ctx context.Context, key string, offset, length, size int64) (io.ReadCloser, error) {
+	if rf, ok := p.Backend.(RangeFetcher); ok && length < size {
+		return rf.FetchRange(ctx, key, offset, length)
+	}
+
+	body, err := p.Fetch(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.CopyN(io.Discard, body, offset); err != nil {
+		body.Close()
+		return nil, err
+	}
+
+	return body, nil
+}
+
+// verifiedCopy streams a complete blob while verifying its digest.
+//
+// The last byte is held back until the digest has been verified, so
+// that clients never receive a complete but corrupt blob. As the
+// response is then shorter than its Content-Length, the connection
+// is closed and clients see an error.
+func verifiedCopy(w io.Writer, r io.Reader, digest string, size int64) error {
+	shasum := sha256.New()
+	tee := io.TeeReader(r, shasum)
+
+	if _, err := io.CopyN(w, tee, size-1); err != nil {
+		return err
+	}
+
+	last := make([]byte, 1)
+	if _, err := io.ReadFull(tee, last); err != nil {
+		return err
+	}
+
+	if actual := fmt.Sprintf("%x", shasum.Sum(nil)); actual != digest {
+		return fmt.Errorf("digest mismatch of proxied blob %s: got %s", digest, actual)
+	}
+
+	_, err := w.Write(last)
+	return err
+}
+
+// ifRangeMatches checks the If-Range precondition, which is satisfied
+// if it is absent or matches the blob.
+func ifRangeMatches(ifRange, etag string, modified time.Time) bool {
+	if ifRange == "" || ifRange == etag {
+		return true
+	}
+
+	t, err := http.ParseTime(ifRange)
+	return err == nil && !modified.Truncate(time.Second).After(t)
+}
+
+// parseRange parses a Range header for a blob of the given size. A
+// negative start means that the whole blob should be served, which is
+// done for multiple ranges as the server is allowed to ignore them.
+func parseRange(header string, size int64) (start, end int64, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return -1, -1, true
+	}
+
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false
+	}
+
+	if first == "" {
+		// Suffix ranges request the last bytes of the blob.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, false
+		}
+
+		return max(size-n, 0), size - 1, true
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+
+	end = size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+
+		end = min(end, size-1)
+	}
+
+	return start, end, true
+}
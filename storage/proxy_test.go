@@ -0,0 +1,154 @@
+// Copyright The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package storage
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseRange(t *testing.T) {
+	type result struct {
+		Start, End int64
+		Ok         bool
+	}
+
+	cases := map[string]result{
+		"bytes=0-9":     {0, 9, true},
+		"bytes=5-":      {5, 99, true},
+		"bytes=90-200":  {90, 99, true},
+		"bytes=-10":     {90, 99, true},
+		"bytes=-200":    {0, 99, true},
+		"bytes=0-1,5-6": {-1, -1, true},
+		"items=0-9":     {-1, -1, true},
+		"bytes=100-":    {0, 0, false},
+		"bytes=9-5":     {0, 0, false},
+		"bytes=-0":      {0, 0, false},
+		"bytes=abc":     {0, 0, false},
+	}
+
+	for header, expected := range cases {
+		start, end, ok := parseRange(header, 100)
+		if diff := cmp.Diff(expected, result{start, end, ok}); diff != "" {
+			t.Errorf("unexpected result for %q:\n%s", header, diff)
+		}
+	}
+}
+
+func TestProxyBackend(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("STORAGE_PATH", dir)
+
+	fs, err := NewFSBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := "0123456789abcdef"
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+	persistString(t, fs, "layers/"+digest, "application/x-test", content)
+
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+	proxy := NewProxyBackend(fs, ProxyOptions{
+		Networks: []*net.IPNet{network},
+		Verify:   true,
+	})
+
+	serve := func(remote string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remote
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+
+		rec := httptest.NewRecorder()
+		proxy.Serve(digest, req, rec)
+		return rec
+	}
+
+	// Clients outside of the proxied networks are served by the
+	// wrapped backend.
+	if rec := serve("192.0.2.1:1234"); rec.Header().Get("Docker-Content-Digest") != "" {
+		t.Error("request from outside of the proxied networks was proxied")
+	}
+
+	// Behind trusted reverse proxies, the client is the last
+	// untrusted address they forwarded the request for.
+	_, trusted, _ := net.ParseCIDR("192.0.2.0/24")
+	proxy.opts.TrustedProxies = []*net.IPNet{trusted}
+
+	forwarded := map[string]bool{
+		"10.1.2.3":                true,
+		"10.1.2.3, 192.0.2.7":     true,
+		"192.0.2.9, 198.51.100.1": false,
+		"10.1.2.3, 198.51.100.1":  false,
+		"not an address":          false,
+	}
+	for header, proxied := range forwarded {
+		rec := serve("192.0.2.1:1234", "X-Forwarded-For", header)
+		if (rec.Header().Get("Docker-Content-Digest") != "") != proxied {
+			t.Errorf("request forwarded for %q was proxied: %v, expected %v", header, !proxied, proxied)
+		}
+	}
+
+	if rec := serve("198.51.100.1:1234", "X-Forwarded-For", "10.1.2.3"); rec.Header().Get("Docker-Content-Digest") != "" {
+		t.Error("X-Forwarded-For of an untrusted client was used")
+	}
+
+	proxy.opts.TrustedProxies = nil
+
+	rec := serve("10.1.2.3:1234")
+	expectedHeaders := map[string]string{
+		"Content-Length":        "16",
+		"Content-Type":          "application/x-test",
+		"Docker-Content-Digest": "sha256:" + digest,
+		"Accept-Ranges":         "bytes",
+	}
+	for h, v := range expectedHeaders {
+		if actual := rec.Header().Get(h); actual != v {
+			t.Errorf("unexpected %s header %q, expected %q", h, actual, v)
+		}
+	}
+
+	if rec.Code != 200 || rec.Body.String() != content {
+		t.Errorf("unexpected full response: %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = serve("10.1.2.3:1234", "Range", "bytes=-4")
+	if rec.Code != 206 || rec.Body.String() != "cdef" || rec.Header().Get("Content-Range") != "bytes 12-15/16" {
+		t.Errorf("unexpected suffix range response: %d %q %q", rec.Code, rec.Body.String(), rec.Header().Get("Content-Range"))
+	}
+
+	etag := rec.Header().Get("ETag")
+	rec = serve("10.1.2.3:1234", "Range", "bytes=10-", "If-Range", etag)
+	if rec.Code != 206 || rec.Body.String() != "abcdef" {
+		t.Errorf("unexpected resumed response: %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = serve("10.1.2.3:1234", "Range", "bytes=10-", "If-Range", `"sha256:other"`)
+	if rec.Code != 200 || rec.Body.String() != content {
+		t.Errorf("range was not ignored for mismatching If-Range: %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = serve("10.1.2.3:1234", "Range", "bytes=16-")
+	if rec.Code != 416 || rec.Header().Get("Content-Range") != "bytes */16" {
+		t.Errorf("unexpected response for unsatisfiable range: %d %q", rec.Code, rec.Header().Get("Content-Range"))
+	}
+
+	// Corrupt blobs must not be served completely.
+	if err := os.WriteFile(path.Join(dir, "layers", digest), []byte("0123456789abcdeX"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = serve("10.1.2.3:1234")
+	if rec.Body.Len() >= len(content) {
+		t.Errorf("corrupt blob was served completely: %q", rec.Body.String())
+	}
+}
@@ -0,0 +1,738 @@
+// Copyright The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+
+// OCI registry storage backend for Nixery.
+//
+// Registries only store content-addressed blobs, and may garbage
+// collect blobs that are not referenced by any manifest. Every object
+// is therefore stored as a blob that is referenced by a small artifact
+// manifest, which is tagged with the path of the object.
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	registryManifestType = "application/vnd.oci.image.manifest.v1+json"
+	registryArtifactType = "application/vnd.nixery.object.v1"
+
+	// Annotations of object manifests, recording the path and
+	// creation time of the object.
+	registryPathAnnotation    = "com.google.nixery.path"
+	registryCreatedAnnotation = "org.opencontainers.image.created"
+)
+
+// Object manifests use the empty JSON object as their config blob.
+var (
+	registryEmptyConfigData = []byte("{}")
+	registryEmptyConfig     = registryDescriptor{
+		MediaType: "application/vnd.oci.empty.v1+json",
+		Digest:    fmt.Sprintf("sha256:%x", sha256.Sum256(registryEmptyConfigData)),
+		Size:      int64(len(registryEmptyConfigData)),
+	}
+)
+
+// Tags may only contain a limited set of characters, see
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#pulling-manifests
+var registryTagPattern = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+
+var registryLinkPattern = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+var registryChallengePattern = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+type registryDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+type registryManifest struct {
+	SchemaVersion int                  `json:"schemaVersion"`
+	MediaType     string               `json:"mediaType"`
+	ArtifactType  string               `json:"artifactType"`
+	Config        registryDescriptor   `json:"config"`
+	Layers        []registryDescriptor `json:"layers"`
+	Annotations   map[string]string    `json:"annotations"`
+}
+
+type RegistryBackend struct {
+	base       *url.URL
+	repository string
+	client     *http.Client
+	auth       *registryAuth
+}
+
+// registryAuth authorises requests to the upstream registry, using
+// either basic authentication or bearer tokens issued by the token
+// service of the registry.
+type registryAuth struct {
+	client   *http.Client
+	username string
+	password string
+
+	// Parameters of the bearer token challenge, if the registry
+	// uses token authentication.
+	realm   string
+	service string
+	scope   string
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// Constructs a new registry backend based on the configured
+// environment variables.
+func NewRegistryBackend() (*RegistryBackend, error) {
+	u := os.Getenv("REGISTRY_URL")
+	if u == "" {
+		return nil, fmt.Errorf("REGISTRY_URL must be configured for registry usage")
+	}
+
+	repository := os.Getenv("REGISTRY_REPOSITORY")
+	if repository == "" {
+		return nil, fmt.Errorf("REGISTRY_REPOSITORY must be configured for registry usage")
+	}
+
+	base, err := url.Parse(u)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REGISTRY_URL %q: %w", u, err)
+	}
+
+	client := &http.Client{}
+	b := &RegistryBackend{
+		base:       base,
+		repository: repository,
+		client:     client,
+		auth: &registryAuth{
+			client:   client,
+			username: os.Getenv("REGISTRY_USERNAME"),
+			password: os.Getenv("REGISTRY_PASSWORD"),
+			scope:    fmt.Sprintf("repository:%s:pull,push,delete", repository),
+		},
+	}
+
+	ctx := context.Background()
+	if err := b.discoverAuth(ctx); err != nil {
+		return nil, fmt.Errorf("could not access registry %q: %w", u, err)
+	}
+
+	if err := b.ensureEmptyConfig(ctx); err != nil {
+		return nil, fmt.Errorf("could not write to repository %q: %w", repository, err)
+	}
+
+	return b, nil
+}
+
+// discoverAuth probes the registry API to find out which
+// authentication scheme it uses.
+func (b *RegistryBackend) discoverAuth(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", b.base.JoinPath("v2/").String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized:
+		challenge := resp.Header.Get("WWW-Authenticate")
+		if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+			// Basic authentication needs no further setup.
+			return nil
+		}
+
+		for _, param := range registryChallengePattern.FindAllStringSubmatch(challenge, -1) {
+			switch param[1] {
+			case "realm":
+				b.auth.realm = param[2]
+			case "service":
+				b.auth.service = param[2]
+			}
+		}
+
+		if b.auth.realm == "" {
+			return fmt.Errorf("registry requested token authentication without a realm")
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("unexpected status from registry API: %s", resp.Status)
+	}
+}
+
+func (a *registryAuth) authorise(req *http.Request) error {
+	if a.realm == "" {
+		if a.username != "" {
+			req.SetBasicAuth(a.username, a.password)
+		}
+
+		return nil
+	}
+
+	token, err := a.bearerToken(req.Context())
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// bearerToken returns a token for the configured repository, fetching
+// a new one from the token service once the previous one expires.
+func (a *registryAuth) bearerToken(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token != "" && time.Now().Before(a.expiry) {
+		return a.token, nil
+	}
+
+	u, err := url.Parse(a.realm)
+	if err != nil {
+		return "", fmt.Errorf("invalid token realm %q: %w", a.realm, err)
+	}
+
+	q := u.Query()
+	if a.service != "" {
+		q.Set("service", a.service)
+	}
+	q.Set("scope", a.scope)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	if a.username != "" {
+		req.SetBasicAuth(a.username, a.password)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token service returned unexpected status: %s", resp.Status)
+	}
+
+	var t struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", fmt.Errorf("failed to decode token response: %w", err)
+	}
+
+	if t.Token == "" {
+		t.Token = t.AccessToken
+	}
+
+	// The token specification defaults to (and mandates at least)
+	// 60 seconds of validity. Tokens are renewed a little early,
+	// so that they do not expire while a request is in flight.
+	if t.ExpiresIn < 60 {
+		t.ExpiresIn = 60
+	}
+
+	a.token = t.Token
+	a.expiry = time.Now().Add(time.Duration(t.ExpiresIn-10) * time.Second)
+
+	return a.token, nil
+}
+
+func (b *RegistryBackend) Name() string {
+	return "OCI registry (" + b.base.Host + "/" + b.repository + ")"
+}
+
+// endpoint returns the URL of an API endpoint of the repository.
+func (b *RegistryBackend) endpoint(elem ...string) string {
+	return b.base.JoinPath(append([]string{"v2", b.repository}, elem...)...).String()
+}
+
+// do sends an authorised request to the registry, and fails unless
+// the response indicates success. Registries differ in the exact
+// status codes they use.
+func (b *RegistryBackend) do(req *http.Request) (*http.Response, error) {
+	if err := b.auth.authorise(req); err != nil {
+		return nil, fmt.Errorf("failed to authorise registry request: %w", err)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+
+		return nil, &registryError{
+			request: req.Method + " " + req.URL.Path,
+			status:  resp.StatusCode,
+			message: string(bytes.TrimSpace(msg)),
+		}
+	}
+
+	return resp, nil
+}
+
+// registryError is returned for unexpected responses from the
+// registry.
+type registryError struct {
+	request string
+	status  int
+	message string
+}
+
+func (e *registryError) Error() string {
+	return fmt.Sprintf("registry returned unexpected status for %s: %d %s (%s)",
+		e.request, e.status, http.StatusText(e.status), e.message)
+}
+
+// registryTag encodes an object path as a tag. The paths used by
+// Nixery consist of a prefix and a hexadecimal key, which makes the
+// separator the only character that needs to be replaced.
+func registryTag(path string) (string, error) {
+	tag := strings.ReplaceAll(path, "/", ".")
+	if !registryTagPattern.MatchString(tag) {
+		return "", fmt.Errorf("path %q can not be stored as a registry tag", path)
+	}
+
+	return tag, nil
+}
+
+func registryPath(tag string) string {
+	return strings.ReplaceAll(tag, ".", "/")
+}
+
+// startUpload opens a blob upload session and returns its location.
+func (b *RegistryBackend) startUpload(ctx context.Context) (*url.URL, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", b.endpoint("blobs", "uploads")+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return b.base.Parse(resp.Header.Get("Location"))
+}
+
+// finishUpload completes an upload session, optionally with the last
+// chunk of data.
+func (b *RegistryBackend) finishUpload(ctx context.Context, location *url.URL, digest string, data []byte) error {
+	q := location.Query()
+	q.Set("digest", digest)
+	location.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", location.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := b.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// ensureEmptyConfig uploads the config blob referenced by all object
+// manifests, unless it is already present.
+func (b *RegistryBackend) ensureEmptyConfig(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", b.endpoint("blobs", registryEmptyConfig.Digest), nil)
+	if err != nil {
+		return err
+	}
+
+	if resp, err := b.do(req); err == nil {
+		resp.Body.Close()
+		return nil
+	}
+
+	location, err := b.startUpload(ctx)
+	if err != nil {
+		return err
+	}
+
+	return b.finishUpload(ctx, location, registryEmptyConfig.Digest, registryEmptyConfigData)
+}
+
+func (b *RegistryBackend) putManifest(ctx context.Context, path string, blob registryDescriptor) error {
+	tag, err := registryTag(path)
+	if err != nil {
+		return err
+	}
+
+	m, err := json.Marshal(registryManifest{
+		SchemaVersion: 2,
+		MediaType:     registryManifestType,
+		ArtifactType:  registryArtifactType,
+		Config:        registryEmptyConfig,
+		Layers:        []registryDescriptor{blob},
+		Annotations: map[string]string{
+			registryPathAnnotation:    path,
+			registryCreatedAnnotation: time.Now().UTC().Format(time.RFC3339),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", b.endpoint("manifests", tag), bytes.NewReader(m))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", registryManifestType)
+
+	resp, err := b.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// fetchManifest retrieves the manifest of an object, and returns it
+// together with its digest.
+func (b *RegistryBackend) fetchManifest(ctx context.Context, path string) (*registryManifest, string, error) {
+	tag, err := registryTag(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", b.endpoint("manifests", tag), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", registryManifestType)
+
+	resp, err := b.do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var m registryManifest
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, "", fmt.Errorf("failed to decode manifest of %q: %w", path, err)
+	}
+
+	if len(m.Layers) != 1 {
+		return nil, "", fmt.Errorf("manifest of %q references %d blobs, expected 1", path, len(m.Layers))
+	}
+
+	return &m, fmt.Sprintf("sha256:%x", sha256.Sum256(raw)), nil
+}
+
+// Persist streams the data into a single chunk of a blob upload, and
+// tags a manifest referencing the blob once the upload is complete.
+func (b *RegistryBackend) Persist(ctx context.Context, path, contentType string, f Persister) (string, int64, error) {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	location, err := b.startUpload(ctx)
+	if err != nil {
+		slog.Error("failed to start registry upload", "err", err, "path", path)
+		return "", 0, err
+	}
+
+	r, w := io.Pipe()
+	req, err := http.NewRequestWithContext(ctx, "PATCH", location.String(), r)
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	// The location of the upload session can change with every
+	// chunk, and is only read once the upload is done.
+	var next *url.URL
+	uploaded := make(chan error, 1)
+	go func() {
+		resp, err := b.do(req)
+		if err == nil {
+			resp.Body.Close()
+			next, err = b.base.Parse(resp.Header.Get("Location"))
+		}
+
+		// Unblocks the writer in case the upload failed early.
+		r.CloseWithError(err)
+		uploaded <- err
+	}()
+
+	shasum := sha256.New()
+	hash, size, err := f(io.MultiWriter(w, shasum))
+	if err != nil {
+		w.CloseWithError(err)
+		<-uploaded
+
+		slog.Error("failed to write to registry", "err", err, "path", path)
+		return hash, size, err
+	}
+
+	w.Close()
+	if err := <-uploaded; err != nil {
+		slog.Error("failed to upload blob to registry", "err", err, "path", path)
+		return hash, size, err
+	}
+
+	digest := fmt.Sprintf("sha256:%x", shasum.Sum(nil))
+	if err := b.finishUpload(ctx, next, digest, nil); err != nil {
+		slog.Error("failed to complete registry upload", "err", err, "path", path)
+		return hash, size, err
+	}
+
+	err = b.putManifest(ctx, path, registryDescriptor{
+		MediaType: contentType,
+		Digest:    digest,
+		Size:      size,
+	})
+	if err != nil {
+		slog.Error("failed to tag object in registry", "err", err, "path", path)
+		return hash, size, err
+	}
+
+	return hash, size, nil
+}
+
+func (b *RegistryBackend) Fetch(ctx context.Context, path string) (io.ReadCloser, error) {
+	return b.fetchBlob(ctx, path, 0, 0)
+}
+
+func (b *RegistryBackend) FetchRange(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	return b.fetchBlob(ctx, path, offset, length)
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// fetchBlob retrieves the blob of an object, or a range of it if the
+// length is positive.
+func (b *RegistryBackend) fetchBlob(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	m, _, err := b.fetchManifest(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", b.endpoint("blobs", m.Layers[0].Digest), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if length <= 0 {
+		resp, err := b.do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		return resp.Body, nil
+	}
+
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := b.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Registries are allowed to ignore the range and return the
+	// whole blob instead.
+	if resp.StatusCode != http.StatusPartialContent {
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+
+	return limitedReadCloser{io.LimitReader(resp.Body, length), resp.Body}, nil
+}
+
+// Move tags the blob of the old object with the new path, and deletes
+// the old object. No data is copied.
+func (b *RegistryBackend) Move(ctx context.Context, old, new string) error {
+	m, _, err := b.fetchManifest(ctx, old)
+	if err != nil {
+		return err
+	}
+
+	if err := b.putManifest(ctx, new, m.Layers[0]); err != nil {
+		return err
+	}
+
+	if err := b.Delete(ctx, old); err != nil {
+		slog.Warn("failed to delete moved object", "err", err, "new", new, "old", old)
+
+		// this error should not break renaming and is not returned
+	}
+
+	return nil
+}
+
+// Serve redirects the client to the blob in the upstream registry,
+// which only works if the repository allows anonymous pulls. Clients
+// that can not pull from the upstream registry need to be served
+// through a ProxyBackend.
+func (b *RegistryBackend) Serve(digest string, r *http.Request, w http.ResponseWriter) error {
+	slog.Info("redirecting blob request to upstream registry", "digest", digest)
+
+	w.Header().Set("Location", b.endpoint("blobs", "sha256:"+digest))
+	w.WriteHeader(303)
+	return nil
+}
+
+func (b *RegistryBackend) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	tagPrefix := strings.ReplaceAll(prefix, "/", ".")
+	next := b.endpoint("tags", "list") + "?n=1000"
+
+	for next != "" {
+		req, err := http.NewRequestWithContext(ctx, "GET", next, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := b.do(req)
+		if err != nil {
+			// Repositories only exist once something has been
+			// pushed to them, which is not an error.
+			var rerr *registryError
+			if errors.As(err, &rerr) && rerr.status == http.StatusNotFound {
+				return nil, nil
+			}
+
+			return nil, err
+		}
+
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode tag list: %w", err)
+		}
+
+		for _, tag := range page.Tags {
+			if !strings.HasPrefix(tag, tagPrefix) {
+				continue
+			}
+
+			info, err := b.Stat(ctx, registryPath(tag))
+			if err != nil {
+				return nil, err
+			}
+
+			objects = append(objects, info)
+		}
+
+		next = ""
+		if link := registryLinkPattern.FindStringSubmatch(resp.Header.Get("Link")); link != nil {
+			u, err := b.base.Parse(link[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid tag list link %q: %w", link[1], err)
+			}
+
+			next = u.String()
+		}
+	}
+
+	return objects, nil
+}
+
+func (b *RegistryBackend) Stat(ctx context.Context, path string) (ObjectInfo, error) {
+	m, _, err := b.fetchManifest(ctx, path)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	// Objects without a valid creation time appear infinitely old.
+	modified, _ := time.Parse(time.RFC3339, m.Annotations[registryCreatedAnnotation])
+
+	return ObjectInfo{
+		Path:        path,
+		Size:        m.Layers[0].Size,
+		Modified:    modified,
+		ContentType: m.Layers[0].MediaType,
+	}, nil
+}
+
+// Delete removes the tag of an object. Blobs are removed by the
+// garbage collection of the registry once they are unreferenced.
+func (b *RegistryBackend) Delete(ctx context.Context, path string) error {
+	tag, err := registryTag(path)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "DELETE", b.endpoint("manifests", tag), nil)
+	if err != nil {
+		return err
+	}
+
+	if resp, err := b.do(req); err == nil {
+		resp.Body.Close()
+		return nil
+	}
+
+	// Registries that do not support deleting tags remove all tags
+	// of a manifest when it is deleted by its digest instead.
+	_, digest, err := b.fetchManifest(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	req, err = http.NewRequestWithContext(ctx, "DELETE", b.endpoint("manifests", digest), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := b.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
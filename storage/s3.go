@@ -0,0 +1,228 @@
+// Copyright The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+
+// S3-compatible storage backend for Nixery (such as Amazon S3 or
+// MinIO).
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Default size of the parts of multipart uploads. Layers are streamed
+// into the bucket, so one part is buffered in memory per upload.
+const defaultS3PartSize = 64 << 20
+
+type S3Backend struct {
+	bucket   string
+	client   *minio.Client
+	partSize uint64
+}
+
+// Constructs a new S3 bucket backend based on the configured
+// environment variables.
+//
+// Credentials are read from the standard AWS or MinIO environment
+// variables, or from the instance metadata service.
+func NewS3Backend() (*S3Backend, error) {
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return nil, fmt.Errorf("S3_BUCKET must be configured for S3 usage")
+	}
+
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "s3.amazonaws.com"
+	}
+
+	lookup := minio.BucketLookupAuto
+	if os.Getenv("S3_PATH_STYLE") == "true" {
+		lookup = minio.BucketLookupPath
+	}
+
+	partSize := uint64(defaultS3PartSize)
+	if p := os.Getenv("S3_PART_SIZE_MB"); p != "" {
+		mb, err := strconv.ParseUint(p, 10, 64)
+		if err != nil || mb < 5 {
+			return nil, fmt.Errorf("S3_PART_SIZE_MB must be a number of at least 5, got %q", p)
+		}
+
+		partSize = mb << 20
+	}
+
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.EnvMinio{},
+		&credentials.IAM{},
+	})
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:        creds,
+		Secure:       os.Getenv("S3_INSECURE") != "true",
+		Region:       os.Getenv("S3_REGION"),
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up S3 client: %w", err)
+	}
+
+	exists, err := client.BucketExists(context.Background(), bucket)
+	if err != nil {
+		return nil, fmt.Errorf("could not access configured bucket %q: %w", bucket, err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("configured bucket %q does not exist", bucket)
+	}
+
+	return &S3Backend{
+		bucket:   bucket,
+		client:   client,
+		partSize: partSize,
+	}, nil
+}
+
+func (b *S3Backend) Name() string {
+	return "S3 (" + b.client.EndpointURL().Host + "/" + b.bucket + ")"
+}
+
+// Persist streams the data into the bucket. As the size is not known
+// in advance, the upload is performed as a multipart upload.
+func (b *S3Backend) Persist(ctx context.Context, path, contentType string, f Persister) (string, int64, error) {
+	r, w := io.Pipe()
+
+	uploaded := make(chan error, 1)
+	go func() {
+		_, err := b.client.PutObject(ctx, b.bucket, path, r, -1, minio.PutObjectOptions{
+			ContentType: contentType,
+			PartSize:    b.partSize,
+		})
+
+		// Unblocks the writer in case the upload failed early.
+		r.CloseWithError(err)
+		uploaded <- err
+	}()
+
+	hash, size, err := f(w)
+	if err != nil {
+		w.CloseWithError(err)
+		<-uploaded
+
+		slog.Error("failed to write to S3", "err", err, "path", path)
+		return hash, size, err
+	}
+
+	w.Close()
+	if err := <-uploaded; err != nil {
+		slog.Error("failed to complete S3 upload", "err", err, "path", path)
+		return hash, size, err
+	}
+
+	return hash, size, nil
+}
+
+func (b *S3Backend) Fetch(ctx context.Context, path string) (io.ReadCloser, error) {
+	// Probe whether the file exists before trying to fetch it, as
+	// errors are otherwise only returned when reading.
+	if _, err := b.client.StatObject(ctx, b.bucket, path, minio.StatObjectOptions{}); err != nil {
+		return nil, err
+	}
+
+	return b.client.GetObject(ctx, b.bucket, path, minio.GetObjectOptions{})
+}
+
+// Move copies the object on the server side and deletes the original,
+// as S3 does not support renaming objects.
+func (b *S3Backend) Move(ctx context.Context, old, new string) error {
+	// Composing an object from a single source is a server-side
+	// copy that also supports objects larger than 5GiB.
+	_, err := b.client.ComposeObject(ctx,
+		minio.CopyDestOptions{Bucket: b.bucket, Object: new},
+		minio.CopySrcOptions{Bucket: b.bucket, Object: old},
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := b.client.RemoveObject(ctx, b.bucket, old, minio.RemoveObjectOptions{}); err != nil {
+		slog.Warn("failed to delete moved object", "err", err, "new", new, "old", old)
+
+		// this error should not break renaming and is not returned
+	}
+
+	return nil
+}
+
+// Serve redirects the client to a presigned URL of the blob, which
+// allows unauthenticated clients to retrieve objects from the bucket.
+func (b *S3Backend) Serve(digest string, r *http.Request, w http.ResponseWriter) error {
+	url, err := b.client.PresignedGetObject(r.Context(), b.bucket, "layers/"+digest, 5*time.Minute, nil)
+	if err != nil {
+		slog.Error("failed to presign S3 URL", "err", err, "digest", digest, "bucket", b.bucket)
+
+		return err
+	}
+
+	slog.Info("redirecting blob request to S3 bucket", "digest", digest)
+
+	w.Header().Set("Location", url.String())
+	w.WriteHeader(303)
+	return nil
+}
+
+func (b *S3Backend) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	for obj := range b.client.ListObjects(ctx, b.bucket, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+
+		objects = append(objects, ObjectInfo{
+			Path:     obj.Key,
+			Size:     obj.Size,
+			Modified: obj.LastModified,
+		})
+	}
+
+	return objects, nil
+}
+
+func (b *S3Backend) Stat(ctx context.Context, path string) (ObjectInfo, error) {
+	obj, err := b.client.StatObject(ctx, b.bucket, path, minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	return ObjectInfo{
+		Path:        obj.Key,
+		Size:        obj.Size,
+		Modified:    obj.LastModified,
+		ContentType: obj.ContentType,
+	}, nil
+}
+
+func (b *S3Backend) FetchRange(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	opts := minio.GetObjectOptions{}
+	if err := opts.SetRange(offset, offset+length-1); err != nil {
+		return nil, err
+	}
+
+	return b.client.GetObject(ctx, b.bucket, path, opts)
+}
+
+func (b *S3Backend) Delete(ctx context.Context, path string) error {
+	return b.client.RemoveObject(ctx, b.bucket, path, minio.RemoveObjectOptions{})
+}
@@ -0,0 +1,80 @@
+// Copyright The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestS3Backend runs against a local MinIO instance, for example:
+//
+//	docker run -p 9000:9000 minio/minio server /data
+//
+// It is skipped unless S3_TEST_ENDPOINT is set. The bucket given in
+// S3_BUCKET must already exist.
+func TestS3Backend(t *testing.T) {
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT is not set")
+	}
+
+	t.Setenv("S3_ENDPOINT", endpoint)
+	t.Setenv("S3_PATH_STYLE", "true")
+	t.Setenv("S3_INSECURE", "true")
+
+	b, err := NewS3Backend()
+	if err != nil {
+		t.Fatalf("failed to set up S3 backend: %s", err)
+	}
+
+	ctx := context.Background()
+	content := strings.Repeat("nixery", 1<<20)
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+
+	_, size, err := b.Persist(ctx, "staging/"+digest, "application/octet-stream", func(w io.Writer) (string, int64, error) {
+		n, err := io.WriteString(w, content)
+		return digest, int64(n), err
+	})
+	if err != nil {
+		t.Fatalf("failed to persist object: %s", err)
+	}
+
+	if err := b.Move(ctx, "staging/"+digest, "layers/"+digest); err != nil {
+		t.Fatalf("failed to move object: %s", err)
+	}
+	defer b.Delete(ctx, "layers/"+digest)
+
+	if _, err := b.Fetch(ctx, "staging/"+digest); err == nil {
+		t.Error("moved object is still present in staging area")
+	}
+
+	info, err := b.Stat(ctx, "layers/"+digest)
+	if err != nil || info.Size != size {
+		t.Fatalf("unexpected object info %+v: %v", info, err)
+	}
+
+	// The presigned URL must be usable without credentials.
+	rec := httptest.NewRecorder()
+	if err := b.Serve(digest, httptest.NewRequest("GET", "/", nil), rec); err != nil {
+		t.Fatalf("failed to serve object: %s", err)
+	}
+
+	resp, err := http.Get(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("failed to fetch presigned URL: %s", err)
+	}
+	defer resp.Body.Close()
+
+	fetched, err := io.ReadAll(resp.Body)
+	if err != nil || string(fetched) != content {
+		t.Fatalf("presigned URL returned unexpected content (status %d): %v", resp.StatusCode, err)
+	}
+}
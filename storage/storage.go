@@ -8,12 +8,28 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"io"
+	"io/fs"
 	"net/http"
+	"time"
+
+	gcs "cloud.google.com/go/storage"
+	"github.com/minio/minio-go/v7"
 )
 
 type Persister = func(io.Writer) (string, int64, error)
 
+// ObjectInfo describes an object stored in a storage backend.
+type ObjectInfo struct {
+	Path     string
+	Size     int64
+	Modified time.Time
+
+	// ContentType is only guaranteed to be set by Stat.
+	ContentType string
+}
+
 type Backend interface {
 	// Name returns the name of the storage backend, for use in
 	// log messages and such.
@@ -37,4 +53,29 @@ type Backend interface {
 	// Serve provides a handler function to serve HTTP requests
 	// for objects in the storage backend.
 	Serve(digest string, r *http.Request, w http.ResponseWriter) error
+
+	// List returns all objects whose path starts with the given
+	// prefix.
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+
+	// Stat returns information about a single object.
+	Stat(ctx context.Context, path string) (ObjectInfo, error)
+
+	// Delete removes an object from the storage backend.
+	Delete(ctx context.Context, path string) error
+}
+
+// IsNotFound reports whether an error returned by a storage backend
+// means that the object does not exist.
+func IsNotFound(err error) bool {
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, gcs.ErrObjectNotExist) {
+		return true
+	}
+
+	var rerr *registryError
+	if errors.As(err, &rerr) {
+		return rerr.status == http.StatusNotFound
+	}
+
+	return minio.ToErrorResponse(err).StatusCode == http.StatusNotFound
 }
@@ -0,0 +1,36 @@
+// Copyright The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package storage
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func TestIsNotFound(t *testing.T) {
+	b, err := newFSBackend(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, fsErr := b.Fetch(context.Background(), "layers/missing")
+
+	cases := map[error]bool{
+		fsErr: true,
+		&registryError{status: http.StatusNotFound}:                true,
+		&registryError{status: http.StatusUnauthorized}:            false,
+		minio.ErrorResponse{Code: "NoSuchKey", StatusCode: 404}:    true,
+		minio.ErrorResponse{Code: "AccessDenied", StatusCode: 403}: false,
+		errors.New("connection reset"):                             false,
+	}
+
+	for err, expected := range cases {
+		if IsNotFound(err) != expected {
+			t.Errorf("IsNotFound(%v) != %v", err, expected)
+		}
+	}
+}
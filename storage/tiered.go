@@ -0,0 +1,394 @@
+// Copyright The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+
+// Tiered storage, keeping a size-bounded local copy of the objects of
+// a remote storage backend.
+package storage
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TieredBackend wraps a remote storage backend with a local cache on
+// the filesystem.
+//
+// Objects are written through to both tiers on Persist, and copied
+// into the local tier when they are fetched. The remote backend stays
+// authoritative: Listing and inspecting objects always uses it, and
+// the local tier only ever holds objects that exist remotely.
+type TieredBackend struct {
+	Backend
+
+	local      *FSBackend
+	serveLocal bool
+
+	mu    sync.Mutex
+	limit int64
+	size  int64
+	order *list.List // most recently used at the front
+	items map[string]*list.Element
+}
+
+type tieredEntry struct {
+	path string
+	size int64
+}
+
+// NewTieredBackend places a local cache of at most limit bytes in the
+// given directory in front of the remote backend. If serveLocal is
+// set, blobs present in the local cache are served from it instead of
+// redirecting clients to the remote backend.
+func NewTieredBackend(remote Backend, dir string, limit int64, serveLocal bool) (*TieredBackend, error) {
+	local, err := newFSBackend(dir, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open local cache: %w", err)
+	}
+
+	b := &TieredBackend{
+		Backend:    remote,
+		local:      local,
+		serveLocal: serveLocal,
+		limit:      limit,
+		order:      list.New(),
+		items:      make(map[string]*list.Element),
+	}
+
+	// Objects are touched whenever they are used, so that the
+	// order of use survives restarts.
+	objects, err := local.List(context.Background(), "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list local cache: %w", err)
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Modified.Before(objects[j].Modified)
+	})
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, o := range objects {
+		b.items[o.Path] = b.order.PushFront(&tieredEntry{o.Path, o.Size})
+		b.size += o.Size
+	}
+	b.evict()
+
+	slog.Info("opened local storage cache", "path", dir, "objects", len(b.items), "size", b.size, "limit", limit)
+
+	return b, nil
+}
+
+// evict removes the least recently used objects from the local cache
+// until it fits into its limit. The caller must hold the mutex.
+func (b *TieredBackend) evict() {
+	for b.size > b.limit {
+		oldest := b.order.Back()
+		entry := oldest.Value.(*tieredEntry)
+		b.order.Remove(oldest)
+		delete(b.items, entry.path)
+		b.size -= entry.size
+
+		if err := b.local.Delete(context.Background(), entry.path); err != nil {
+			slog.Warn("failed to evict object from local cache", "err", err, "path", entry.path)
+		}
+	}
+}
+
+// cached checks whether an object is in the local cache, and marks it
+// as recently used.
+func (b *TieredBackend) cached(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e, ok := b.items[key]
+	if !ok {
+		return false
+	}
+
+	b.order.MoveToFront(e)
+	b.touch(key)
+
+	return true
+}
+
+// touch updates the modification time of a locally cached object,
+// which records its last use. Written files are touched as well, as
+// the kernel timestamps writes with a coarser clock.
+func (b *TieredBackend) touch(key string) {
+	now := time.Now()
+	os.Chtimes(path.Join(b.local.path, key), now, now)
+}
+
+// track records an object that was written to the local cache.
+func (b *TieredBackend) track(key string, size int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.forget(key)
+	b.items[key] = b.order.PushFront(&tieredEntry{key, size})
+	b.size += size
+	b.touch(key)
+	b.evict()
+}
+
+// forget removes an object from the tracked local objects. The caller
+// must hold the mutex.
+func (b *TieredBackend) forget(key string) {
+	if e, ok := b.items[key]; ok {
+		b.size -= e.Value.(*tieredEntry).size
+		b.order.Remove(e)
+		delete(b.items, key)
+	}
+}
+
+// localCopy writes a copy of an object into the local cache on a
+// best-effort basis. Failures only prevent the object from being
+// cached, and never fail reads from or writes to the remote backend.
+type localCopy struct {
+	b    *TieredBackend
+	key  string
+	file *os.File // nil once writing has failed
+	size int64
+}
+
+func (b *TieredBackend) newLocalCopy(key string) *localCopy {
+	c := &localCopy{b: b, key: key}
+
+	file, err := b.local.createTemp()
+	if err != nil {
+		slog.Warn("failed to write object to local cache", "err", err, "path", key)
+		return c
+	}
+
+	c.file = file
+	return c
+}
+
+func (c *localCopy) Write(p []byte) (int, error) {
+	if c.file == nil {
+		return len(p), nil
+	}
+
+	n, err := c.file.Write(p)
+	c.size += int64(n)
+	if err != nil {
+		slog.Warn("failed to write object to local cache", "err", err, "path", c.key)
+		c.discard()
+	}
+
+	return len(p), nil
+}
+
+// discard removes an incomplete copy.
+func (c *localCopy) discard() {
+	if c.file != nil {
+		c.file.Close()
+		os.Remove(c.file.Name())
+		c.file = nil
+	}
+}
+
+// commit moves a complete copy into the local cache.
+func (c *localCopy) commit(contentType string) {
+	if c.file == nil {
+		return
+	}
+
+	file := c.file
+	c.file = nil
+	defer os.Remove(file.Name())
+
+	full := path.Join(c.b.local.path, c.key)
+	err := c.b.local.setContentType(c.key, file.Name(), contentType)
+	if err == nil {
+		err = commit(file, full)
+	} else {
+		file.Close()
+	}
+
+	if err != nil {
+		slog.Warn("failed to write object to local cache", "err", err, "path", c.key)
+		return
+	}
+
+	c.b.track(c.key, c.size)
+}
+
+// Persist writes the object to the remote backend, and copies it into
+// the local cache once the remote write has succeeded.
+func (b *TieredBackend) Persist(ctx context.Context, key, contentType string, f Persister) (string, int64, error) {
+	cache := b.newLocalCopy(key)
+	hash, size, err := b.Backend.Persist(ctx, key, contentType, func(rw io.Writer) (string, int64, error) {
+		return f(io.MultiWriter(rw, cache))
+	})
+
+	if err != nil {
+		cache.discard()
+		return hash, size, err
+	}
+
+	cache.commit(contentType)
+	return hash, size, nil
+}
+
+// cachingReader copies an object into the local cache while it is
+// streamed from the remote backend. The copy is only kept if the
+// object is read completely.
+type cachingReader struct {
+	io.ReadCloser
+	cache       *localCopy
+	contentType string
+}
+
+func (r *cachingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.cache.Write(p[:n])
+
+	if err == io.EOF {
+		r.cache.commit(r.contentType)
+	}
+
+	return n, err
+}
+
+func (r *cachingReader) Close() error {
+	r.cache.discard()
+	return r.ReadCloser.Close()
+}
+
+// Fetch serves objects from the local cache, and streams objects that
+// are missing from it out of the remote backend while copying them
+// into the local cache.
+func (b *TieredBackend) Fetch(ctx context.Context, key string) (io.ReadCloser, error) {
+	if b.cached(key) {
+		if r, err := b.local.Fetch(ctx, key); err == nil {
+			return r, nil
+		}
+	}
+
+	var contentType string
+	if info, err := b.Backend.Stat(ctx, key); err == nil {
+		contentType = info.ContentType
+	}
+
+	remote, err := b.Backend.Fetch(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cachingReader{remote, b.newLocalCopy(key), contentType}, nil
+}
+
+// FetchRange reads part of an object from the local cache if it is
+// present, and from the remote backend otherwise. Partial reads do not
+// copy objects into the local cache.
+func (b *TieredBackend) FetchRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	if b.cached(key) {
+		if f, err := os.Open(path.Join(b.local.path, key)); err == nil {
+			if _, err := f.Seek(offset, io.SeekStart); err == nil {
+				return limitedReadCloser{io.LimitReader(f, length), f}, nil
+			}
+
+			f.Close()
+		}
+	}
+
+	if rf, ok := b.Backend.(RangeFetcher); ok {
+		return rf.FetchRange(ctx, key, offset, length)
+	}
+
+	r, err := b.Backend.Fetch(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.CopyN(io.Discard, r, offset); err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return limitedReadCloser{io.LimitReader(r, length), r}, nil
+}
+
+func (b *TieredBackend) Move(ctx context.Context, old, new string) error {
+	if err := b.Backend.Move(ctx, old, new); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e, ok := b.items[old]
+	if !ok {
+		return nil
+	}
+
+	size := e.Value.(*tieredEntry).size
+	b.forget(old)
+
+	if err := b.local.Move(ctx, old, new); err != nil {
+		slog.Warn("failed to move object in local cache", "err", err, "old", old, "new", new)
+		b.local.Delete(ctx, old)
+		return nil
+	}
+
+	b.forget(new)
+	b.items[new] = b.order.PushFront(&tieredEntry{new, size})
+	b.size += size
+	b.touch(new)
+
+	return nil
+}
+
+// Serve serves blobs from the local cache if configured, and lets the
+// remote backend serve all other blobs.
+func (b *TieredBackend) Serve(digest string, r *http.Request, w http.ResponseWriter) error {
+	if b.serveLocal && b.cached("layers/"+digest) {
+		return b.local.Serve(digest, r, w)
+	}
+
+	return b.Backend.Serve(digest, r, w)
+}
+
+func (b *TieredBackend) Delete(ctx context.Context, key string) error {
+	if err := b.Backend.Delete(ctx, key); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.items[key]; ok {
+		b.forget(key)
+		if err := b.local.Delete(ctx, key); err != nil {
+			slog.Warn("failed to delete object from local cache", "err", err, "path", key)
+		}
+	}
+
+	return nil
+}
+
+// Uncached returns the backend that holds the authoritative copy of
+// the objects in a storage backend, bypassing local caches. Reading
+// from it does not affect which objects are cached.
+func Uncached(b Backend) Backend {
+	for {
+		switch w := b.(type) {
+		case *ProxyBackend:
+			b = w.Backend
+		case *TieredBackend:
+			return w.Backend
+		default:
+			return b
+		}
+	}
+}
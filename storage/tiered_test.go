@@ -0,0 +1,160 @@
+// Copyright The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package storage
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// redirectingBackend stands in for remote backends, which serve blobs
+// by redirecting clients.
+type redirectingBackend struct {
+	*FSBackend
+}
+
+func (b redirectingBackend) Serve(digest string, r *http.Request, w http.ResponseWriter) error {
+	w.Header().Set("Location", "https://remote.example.com/"+digest)
+	w.WriteHeader(303)
+	return nil
+}
+
+func fetchString(t *testing.T, b Backend, key string) string {
+	r, err := b.Fetch(context.Background(), key)
+	if err != nil {
+		t.Fatalf("failed to fetch %s: %s", key, err)
+	}
+	defer r.Close()
+
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to read %s: %s", key, err)
+	}
+
+	return string(content)
+}
+
+func TestTieredBackend(t *testing.T) {
+	remoteDir, localDir := t.TempDir(), t.TempDir()
+
+	remote, err := newFSBackend(remoteDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewTieredBackend(redirectingBackend{remote}, localDir, 250, true)
+	if err != nil {
+		t.Fatalf("failed to set up tiered backend: %s", err)
+	}
+
+	ctx := context.Background()
+	local := func(key string) bool {
+		_, err := os.Stat(path.Join(localDir, key))
+		return err == nil
+	}
+
+	// Writes go through to both tiers.
+	persistString(t, b, "staging/a", "application/x-a", strings.Repeat("a", 100))
+	if err := b.Move(ctx, "staging/a", "layers/a"); err != nil {
+		t.Fatalf("failed to move object: %s", err)
+	}
+
+	if fetchString(t, remote, "layers/a") != strings.Repeat("a", 100) || !local("layers/a") || local("staging/a") {
+		t.Fatal("object was not written through to both tiers")
+	}
+
+	// Objects are copied into the local tier when fetched.
+	persistString(t, remote, "layers/b", "application/x-b", strings.Repeat("b", 100))
+	if fetchString(t, b, "layers/b") != strings.Repeat("b", 100) || !local("layers/b") {
+		t.Fatal("object was not read through into the local tier")
+	}
+
+	// Serving prefers the local tier.
+	rec := httptest.NewRecorder()
+	b.Serve("b", httptest.NewRequest("GET", "/", nil), rec)
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != "application/x-b" {
+		t.Errorf("cached blob was not served locally: %d %v", rec.Code, rec.Header())
+	}
+
+	// Ranges are read from the local tier if present, without
+	// copying objects into it otherwise.
+	persistString(t, remote, "layers/d", "application/x-d", "0123456789")
+	for key, expected := range map[string]string{"layers/b": "bbb", "layers/d": "345"} {
+		r, err := b.FetchRange(ctx, key, 3, 3)
+		if err != nil {
+			t.Fatalf("failed to fetch range of %s: %s", key, err)
+		}
+
+		content, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || string(content) != expected {
+			t.Errorf("unexpected range of %s: %q (%v)", key, content, err)
+		}
+	}
+
+	if local("layers/d") {
+		t.Error("partially read object was copied into the local tier")
+	}
+
+	if Uncached(NewProxyBackend(b, ProxyOptions{})) != (redirectingBackend{remote}) {
+		t.Error("uncached backend is not the remote backend")
+	}
+
+	// Using "a" makes "b" the least recently used object, which is
+	// evicted once "c" no longer fits.
+	fetchString(t, b, "layers/a")
+	persistString(t, b, "layers/c", "application/x-c", strings.Repeat("c", 100))
+
+	if local("layers/b") || !local("layers/a") || !local("layers/c") {
+		t.Error("least recently used object was not evicted")
+	}
+
+	rec = httptest.NewRecorder()
+	b.Serve("b", httptest.NewRequest("GET", "/", nil), rec)
+	if rec.Code != 303 {
+		t.Errorf("evicted blob was not served by the remote backend: %d", rec.Code)
+	}
+
+	// The eviction order survives restarts.
+	b, err = NewTieredBackend(redirectingBackend{remote}, localDir, 150, true)
+	if err != nil {
+		t.Fatalf("failed to reopen tiered backend: %s", err)
+	}
+
+	if local("layers/a") || !local("layers/c") {
+		t.Error("local tier was not restored in order of use")
+	}
+
+	if err := b.Delete(ctx, "layers/c"); err != nil {
+		t.Fatalf("failed to delete object: %s", err)
+	}
+
+	if local("layers/c") {
+		t.Error("deleted object remains in the local tier")
+	}
+
+	// A broken local tier only prevents caching.
+	if err := os.RemoveAll(path.Join(localDir, tempDir)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path.Join(localDir, tempDir), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	persistString(t, b, "layers/e", "application/x-e", "eee")
+	if fetchString(t, remote, "layers/e") != "eee" || local("layers/e") {
+		t.Error("object was not written to the remote tier only")
+	}
+
+	persistString(t, remote, "layers/f", "application/x-f", "fff")
+	if fetchString(t, b, "layers/f") != "fff" || local("layers/f") {
+		t.Error("object was not read from the remote tier only")
+	}
+}